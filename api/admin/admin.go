@@ -0,0 +1,258 @@
+// Package admin handles the API requests to manage the cache and the database
+// mirror of CheeseGull. All of them require the admin scope.
+package admin
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/osuripple/cheesegull/api"
+	"github.com/osuripple/cheesegull/api/download"
+	"github.com/osuripple/cheesegull/dbmirror"
+	"github.com/osuripple/cheesegull/housekeeper"
+	"github.com/osuripple/cheesegull/models"
+)
+
+func errorMessage(c *api.Context, code int, err string) {
+	c.WriteHeader("Content-Type", "text/plain; charset=utf-8")
+	c.Code(code)
+	c.Write([]byte(err))
+}
+
+// admin wraps a handler so that it can only be used by the clients with the
+// admin scope.
+func admin(f func(c *api.Context)) func(c *api.Context) {
+	return func(c *api.Context) {
+		if c.RequireScope(models.ScopeAdmin) {
+			f(c)
+		}
+	}
+}
+
+// setID parses the ID of the set in the path. If it is not valid, an error is
+// written to the client and 0 is returned.
+func setID(c *api.Context) int {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		errorMessage(c, 400, "Malformed ID")
+		return 0
+	}
+	return id
+}
+
+// CacheEntry is a beatmap in the cache.
+type CacheEntry struct {
+	ID            int
+	NoVideo       bool
+	LastUpdate    time.Time
+	RankedStatus  int
+	Downloaded    bool
+	FileSize      uint64
+	Verification  string
+	LastRequested time.Time
+	Requests      uint64
+	Pinned        bool
+}
+
+func cacheEntry(h *housekeeper.House, b *housekeeper.CachedBeatmap) CacheEntry {
+	u := b.Usage()
+	return CacheEntry{
+		ID:            b.ID,
+		NoVideo:       b.NoVideo,
+		LastUpdate:    u.LastUpdate,
+		RankedStatus:  u.RankedStatus,
+		Downloaded:    b.IsDownloaded(),
+		FileSize:      u.FileSize,
+		Verification:  b.Verification().String(),
+		LastRequested: u.LastRequested,
+		Requests:      u.Requests,
+		Pinned:        h.Pinned(b.ID),
+	}
+}
+
+// Cache lists the beatmaps in the cache.
+func Cache(c *api.Context) {
+	bms := c.House.Beatmaps()
+	entries := make([]CacheEntry, len(bms))
+	for i, b := range bms {
+		entries[i] = cacheEntry(c.House, b)
+	}
+	c.WriteJSON(200, struct {
+		Size    uint64
+		MaxSize uint64
+		Pins    []int
+		Entries []CacheEntry
+	}{c.House.Size(), c.House.MaxSize, c.House.Pins(), entries})
+}
+
+// setEntries returns the beatmaps of a set in the cache.
+func setEntries(h *housekeeper.House, id int) []CacheEntry {
+	entries := []CacheEntry{}
+	for _, noVideo := range []bool{false, true} {
+		if b := h.Lookup(id, noVideo); b != nil {
+			entries = append(entries, cacheEntry(h, b))
+		}
+	}
+	return entries
+}
+
+// CachedSet shows the beatmaps of a set in the cache.
+func CachedSet(c *api.Context) {
+	id := setID(c)
+	if id == 0 {
+		return
+	}
+	entries := setEntries(c.House, id)
+	if len(entries) == 0 && !c.House.Pinned(id) {
+		errorMessage(c, 404, "Set not cached")
+		return
+	}
+	c.WriteJSON(200, entries)
+}
+
+// Evict removes a set from the cache.
+func Evict(c *api.Context) {
+	id := setID(c)
+	if id == 0 {
+		return
+	}
+	removed, err := c.House.Evict(id)
+	if err != nil {
+		c.Err(err)
+		errorMessage(c, 500, "Could not evict the set")
+		return
+	}
+	c.WriteJSON(200, struct{ Evicted int }{len(removed)})
+}
+
+// Pin pins a set, so that it is never evicted from the cache.
+func Pin(c *api.Context) {
+	id := setID(c)
+	if id == 0 {
+		return
+	}
+	if err := c.House.Pin(id); err != nil {
+		c.Err(err)
+		errorMessage(c, 500, "Could not pin the set")
+		return
+	}
+	c.WriteJSON(200, setEntries(c.House, id))
+}
+
+// Unpin removes the pin of a set.
+func Unpin(c *api.Context) {
+	id := setID(c)
+	if id == 0 {
+		return
+	}
+	if err := c.House.Unpin(id); err != nil {
+		c.Err(err)
+		errorMessage(c, 500, "Could not unpin the set")
+		return
+	}
+	c.WriteJSON(200, setEntries(c.House, id))
+}
+
+// Redownload removes a set from the cache and downloads it again in the
+// background, with and without video if both were cached.
+func Redownload(c *api.Context) {
+	id := setID(c)
+	if id == 0 {
+		return
+	}
+	set, err := models.FetchSet(c.DB, id, false)
+	if err != nil {
+		c.Err(err)
+		errorMessage(c, 500, "Could not fetch set")
+		return
+	}
+	if set == nil {
+		errorMessage(c, 404, "Set not found")
+		return
+	}
+
+	removed, err := c.House.Evict(id)
+	if err != nil {
+		c.Err(err)
+		errorMessage(c, 500, "Could not evict the set")
+		return
+	}
+	noVideos := []bool{false}
+	for _, b := range removed {
+		if b.NoVideo && set.HasVideo {
+			noVideos = append(noVideos, true)
+		}
+	}
+	for _, noVideo := range noVideos {
+		download.Acquire(c, set, noVideo)
+	}
+	c.WriteJSON(202, setEntries(c.House, id))
+}
+
+// RefreshSet updates the information about a set in the database from the
+// osu! API.
+func RefreshSet(c *api.Context) {
+	id := setID(c)
+	if id == 0 {
+		return
+	}
+	if c.Options.OsuAPI == nil {
+		errorMessage(c, 503, "The osu! API is not available")
+		return
+	}
+	if err := dbmirror.UpdateSet(c.Options.OsuAPI, c.DB, id); err != nil {
+		c.Err(err)
+		errorMessage(c, 500, "Could not update the set")
+		return
+	}
+	set, err := models.FetchSet(c.DB, id, true)
+	if err != nil {
+		c.Err(err)
+		errorMessage(c, 500, "Could not fetch set")
+		return
+	}
+	if set == nil {
+		// the set has been deleted from osu!.
+		errorMessage(c, 404, "Set not found")
+		return
+	}
+	c.WriteJSON(200, set)
+}
+
+// Discovery shows the state of the discovery of new sets.
+func Discovery(c *api.Context) {
+	c.WriteJSON(200, dbmirror.Discovery())
+}
+
+// Discover starts a discovery of new sets, unless one is already running. The
+// discovery goes on in the background until it is over, or until CheeseGull
+// stops.
+func Discover(c *api.Context) {
+	if c.Options.OsuAPI == nil {
+		errorMessage(c, 503, "The osu! API is not available")
+		return
+	}
+	if !dbmirror.DiscoverInBackground(c.BackgroundContext(), c.Options.OsuAPI, c.DB) {
+		errorMessage(c, 409, "A discovery is already running")
+		return
+	}
+	c.WriteJSON(202, dbmirror.Discovery())
+}
+
+// Updater shows the queue of the set updater.
+func Updater(c *api.Context) {
+	c.WriteJSON(200, dbmirror.Updater())
+}
+
+func init() {
+	api.GET("/api/admin/cache", admin(Cache))
+	api.GET("/api/admin/cache/:id", admin(CachedSet))
+	api.POST("/api/admin/cache/:id/evict", admin(Evict))
+	api.POST("/api/admin/cache/:id/pin", admin(Pin))
+	api.POST("/api/admin/cache/:id/unpin", admin(Unpin))
+	api.POST("/api/admin/cache/:id/redownload", admin(Redownload))
+	api.POST("/api/admin/sets/:id/refresh", admin(RefreshSet))
+	api.GET("/api/admin/discover", admin(Discovery))
+	api.POST("/api/admin/discover", admin(Discover))
+	api.GET("/api/admin/updater", admin(Updater))
+}
@@ -0,0 +1,77 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/osuripple/cheesegull/api"
+	"github.com/osuripple/cheesegull/housekeeper"
+	"github.com/osuripple/cheesegull/models"
+)
+
+func newHouse(t *testing.T) *housekeeper.House {
+	dir := t.TempDir()
+	h := housekeeper.New(filepath.Join(dir, "cgbin.db"))
+	h.Storage = housekeeper.LocalStorage(dir)
+	for _, noVideo := range []bool{false, true} {
+		b, _ := h.AcquireBeatmap(&housekeeper.CachedBeatmap{ID: 1, NoVideo: noVideo})
+		b.DownloadCompleted(20000, h)
+	}
+	return h
+}
+
+func request(h *housekeeper.House, scopes []string, method, path string) *httptest.ResponseRecorder {
+	handler := api.CreateHandler(nil, nil, h, nil, api.Options{PublicScopes: scopes})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w
+}
+
+func TestRequiresAdmin(t *testing.T) {
+	h := newHouse(t)
+	w := request(h, []string{models.ScopeDownload}, "POST", "/api/admin/cache/1/evict")
+	require.Equal(t, 401, w.Code)
+	require.Len(t, h.Beatmaps(), 2)
+}
+
+func TestCache(t *testing.T) {
+	h := newHouse(t)
+	admin := []string{models.ScopeAdmin}
+
+	w := request(h, admin, "POST", "/api/admin/cache/1/pin")
+	require.Equal(t, 200, w.Code)
+	var entries []CacheEntry
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+	require.Len(t, entries, 2)
+	require.True(t, entries[0].Pinned)
+	require.True(t, entries[1].NoVideo)
+	require.Equal(t, uint64(20000), entries[1].FileSize)
+
+	w = request(h, admin, "GET", "/api/admin/cache")
+	require.Equal(t, 200, w.Code)
+	var cache struct {
+		Size    uint64
+		Pins    []int
+		Entries []CacheEntry
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &cache))
+	require.Equal(t, uint64(40000), cache.Size)
+	require.Equal(t, []int{1}, cache.Pins)
+	require.Len(t, cache.Entries, 2)
+
+	w = request(h, admin, "POST", "/api/admin/cache/1/evict")
+	require.Equal(t, 200, w.Code)
+	require.JSONEq(t, `{"Evicted": 2}`, w.Body.String())
+	require.Empty(t, h.Beatmaps())
+
+	// the pin is kept, so the set can still be inspected.
+	w = request(h, admin, "GET", "/api/admin/cache/1")
+	require.Equal(t, 200, w.Code)
+	require.JSONEq(t, `[]`, w.Body.String())
+	require.Equal(t, 404, request(h, admin, "GET", "/api/admin/cache/2").Code)
+	require.Equal(t, 400, request(h, admin, "GET", "/api/admin/cache/x").Code)
+}
@@ -3,10 +3,12 @@
 package api
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"runtime/debug"
@@ -14,9 +16,11 @@ import (
 
 	raven "github.com/getsentry/raven-go"
 	"github.com/julienschmidt/httprouter"
+	osuapi "github.com/thehowl/go-osuapi"
 
 	"github.com/osuripple/cheesegull/downloader"
 	"github.com/osuripple/cheesegull/housekeeper"
+	"github.com/osuripple/cheesegull/models"
 )
 
 // Context is the information that is passed to all request handlers in relation
@@ -29,7 +33,17 @@ type Context struct {
 	DLClient downloader.Client
 	writer   http.ResponseWriter
 	params   httprouter.Params
+	route    string
 	Options  Options
+
+	requestID string
+	logger    *slog.Logger
+
+	keys       *apiKeyCache
+	key        *models.APIKey
+	keyErr     error
+	keyChecked bool
+	keyInvalid bool
 }
 
 // Write writes content to the response body.
@@ -66,15 +80,30 @@ func (c *Context) WriteJSON(code int, v interface{}) error {
 
 var envSentryDSN = os.Getenv("SENTRY_DSN")
 
-// Err attempts to log an error to Sentry, as well as stdout.
+// Err attempts to log an error to Sentry, as well as to the Logger.
 func (c *Context) Err(err error) {
 	if err == nil {
 		return
 	}
 	if envSentryDSN != "" {
-		raven.CaptureError(err, nil, raven.NewHttp(c.Request))
+		raven.CaptureError(err, map[string]string{"request_id": c.requestID}, sentryHTTP(c.Request))
 	}
-	log.Println(err)
+	c.Logger().Error("error handling request", "err", err)
+}
+
+// Logger returns the logger of the request, which adds the ID of the request
+// and the IP of the client to everything it logs.
+func (c *Context) Logger() *slog.Logger {
+	if c.logger != nil {
+		return c.logger
+	}
+	return slog.Default()
+}
+
+// RequestID returns the ID of the request, which is also sent to the client
+// in the X-Request-ID header.
+func (c *Context) RequestID() string {
+	return c.requestID
 }
 
 type handlerPath struct {
@@ -94,34 +123,94 @@ func POST(path string, f func(c *Context)) {
 	handlers = append(handlers, handlerPath{"POST", path, f})
 }
 
+// HEAD registers a handler for a HEAD request.
+func HEAD(path string, f func(c *Context)) {
+	handlers = append(handlers, handlerPath{"HEAD", path, f})
+}
+
 type Options struct {
+	// AllowUnranked allows all clients to download unranked sets, rather
+	// than only the ones with the download-unranked scope.
 	AllowUnranked bool
+	// Verify specifies whether downloaded beatmaps should be verified against
+	// the MD5s of their beatmaps, and what to do if they don't match.
+	Verify downloader.VerifyMode
+	// Queue, if not nil, limits the number of beatmaps downloaded at once.
+	Queue *downloader.Queue
+	// Middlewares wrap all the handlers. The first one is the outermost.
+	Middlewares []Middleware
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For header is
+	// used to find the IP of the clients.
+	TrustedProxies []*net.IPNet
+	// PublicScopes are the scopes of the clients without an API key.
+	PublicScopes []string
+	// OsuAPI is the client of the osu! API used to update the sets in the
+	// database.
+	OsuAPI *osuapi.Client
+	// Logger is used to log the requests and their errors. If nil,
+	// slog.Default() is used.
+	Logger *slog.Logger
+	// Background is the context of the work carried on in the background by
+	// the requests, such as the downloads of the beatmaps: once it is done,
+	// that work is aborted. If nil, context.Background() is used.
+	Background context.Context
+	// ReadyMaxStaleness is the most time that may have passed since a set was
+	// last updated in the database for CheeseGull to be ready. 0 means any.
+	ReadyMaxStaleness time.Duration
+}
+
+// BackgroundContext returns Options.Background, or context.Background() if
+// it is nil.
+func (c *Context) BackgroundContext() context.Context {
+	if c.Options.Background != nil {
+		return c.Options.Background
+	}
+	return context.Background()
 }
 
 // CreateHandler creates a new http.Handler using the handlers registered
-// through GET and POST.
+// through GET, POST and HEAD.
 func CreateHandler(db, searchDB *sql.DB, house *housekeeper.House, dlc downloader.Client, options Options) http.Handler {
 	r := httprouter.New()
+	keys := &apiKeyCache{}
 	for _, h := range handlers {
 		// Create local copy that we know won't change as the loop proceeds.
 		h := h
+		f := chain(h.f, options.Middlewares)
 		r.Handle(h.method, h.path, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 			start := time.Now()
+			cw := &countingWriter{ResponseWriter: w}
 			ctx := &Context{
 				Request:  r,
 				DB:       db,
 				SearchDB: searchDB,
 				House:    house,
 				DLClient: dlc,
-				writer:   w,
+				writer:   cw,
 				params:   p,
+				route:    h.path,
 				Options:  options,
+				keys:     keys,
+			}
+			ctx.requestID = requestID(r)
+			cw.Header().Set("X-Request-ID", ctx.requestID)
+			logger := options.Logger
+			if logger == nil {
+				logger = slog.Default()
 			}
+			ctx.logger = logger.With("request_id", ctx.requestID, "client_ip", ctx.ClientIP())
+			// deferred first, so that requests which panicked are logged
+			// too.
+			defer finishRequest(ctx, cw, start)
 			defer func() {
 				err := recover()
 				if err == nil {
 					return
 				}
+				if err == http.ErrAbortHandler {
+					// let net/http abort the response.
+					panic(err)
+				}
 				switch err := err.(type) {
 				case error:
 					ctx.Err(err)
@@ -130,16 +219,11 @@ func CreateHandler(db, searchDB *sql.DB, house *housekeeper.House, dlc downloade
 				case string:
 					ctx.Err(errors.New(err))
 				default:
-					log.Println("PANIC", err)
+					ctx.Logger().Error("panic", "panic", err)
 				}
-				debug.PrintStack()
+				ctx.Logger().Error("stack of the panic", "stack", string(debug.Stack()))
 			}()
-			h.f(ctx)
-			log.Printf("[R] %-10s %-4s %s\n",
-				time.Since(start).String(),
-				r.Method,
-				r.URL.Path,
-			)
+			f(ctx)
 		})
 	}
 	return r
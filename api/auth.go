@@ -0,0 +1,166 @@
+package api
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+
+	"github.com/osuripple/cheesegull/models"
+)
+
+// sentAPIKey returns the API key sent by the client in the X-API-Key header or
+// in the key query parameter.
+func (c *Context) sentAPIKey() string {
+	if key := c.ReadHeader("X-API-Key"); key != "" {
+		return key
+	}
+	return c.Request.URL.Query().Get("key")
+}
+
+// lookUpAPIKey fetches the API key sent by the client from the database, the
+// first time it is called.
+func (c *Context) lookUpAPIKey() {
+	if c.keyChecked {
+		return
+	}
+	c.keyChecked = true
+	sent := c.sentAPIKey()
+	if sent == "" {
+		return
+	}
+	c.key, c.keyErr = c.keys.fetch(c.DB, sent)
+	c.keyInvalid = c.keyErr == nil && c.key == nil
+}
+
+// apiKeyTTL is how long the results of the lookups of the API keys are
+// cached, so that the database is not queried by every request. A revoked key
+// may keep working for this long.
+const apiKeyTTL = time.Minute
+
+// maxCachedAPIKeys is the most API keys an apiKeyCache holds, so that clients
+// sending random keys can't make it grow forever.
+const maxCachedAPIKeys = 10000
+
+// apiKeyCache caches the API keys fetched from the database, as well as the
+// keys which were found not to exist. A nil apiKeyCache caches nothing.
+type apiKeyCache struct {
+	mtx  sync.Mutex
+	keys map[string]cachedAPIKey
+}
+
+type cachedAPIKey struct {
+	key     *models.APIKey
+	expires time.Time
+}
+
+// fetch returns the API key sent by a client, from the cache or from db.
+// Errors are not cached.
+func (kc *apiKeyCache) fetch(db *sql.DB, sent string) (*models.APIKey, error) {
+	if kc == nil {
+		return models.FetchAPIKey(db, sent)
+	}
+	if k, ok := kc.get(sent, time.Now()); ok {
+		return k, nil
+	}
+	k, err := models.FetchAPIKey(db, sent)
+	if err != nil {
+		return nil, err
+	}
+	kc.put(sent, k, time.Now())
+	return k, nil
+}
+
+func (kc *apiKeyCache) get(sent string, now time.Time) (*models.APIKey, bool) {
+	kc.mtx.Lock()
+	defer kc.mtx.Unlock()
+	cached, ok := kc.keys[sent]
+	if !ok || !now.Before(cached.expires) {
+		return nil, false
+	}
+	return cached.key, true
+}
+
+func (kc *apiKeyCache) put(sent string, k *models.APIKey, now time.Time) {
+	kc.mtx.Lock()
+	defer kc.mtx.Unlock()
+	if len(kc.keys) >= maxCachedAPIKeys {
+		for s, cached := range kc.keys {
+			if !now.Before(cached.expires) {
+				delete(kc.keys, s)
+			}
+		}
+	}
+	if kc.keys == nil || len(kc.keys) >= maxCachedAPIKeys {
+		kc.keys = make(map[string]cachedAPIKey)
+	}
+	kc.keys[sent] = cachedAPIKey{key: k, expires: now.Add(apiKeyTTL)}
+}
+
+// sentryHTTP describes a request to Sentry, without the API key sent by the
+// client.
+func sentryHTTP(r *http.Request) *raven.Http {
+	h := raven.NewHttp(r)
+	if _, ok := h.Headers["X-Api-Key"]; ok {
+		h.Headers["X-Api-Key"] = "********"
+	}
+	if q, err := url.ParseQuery(h.Query); err == nil && q.Has("key") {
+		q.Set("key", "********")
+		h.Query = q.Encode()
+	}
+	return h
+}
+
+// APIKey returns the API key the client authenticated with, or nil if it sent
+// none or the one it sent is not valid.
+func (c *Context) APIKey() *models.APIKey {
+	c.lookUpAPIKey()
+	return c.key
+}
+
+// HasScope checks whether the client may do what the scope allows: either its
+// API key has the scope, or the scope is one of Options.PublicScopes and the
+// client has not sent an invalid key.
+func (c *Context) HasScope(scope string) bool {
+	c.lookUpAPIKey()
+	if c.key != nil {
+		return c.key.HasScope(scope)
+	}
+	if c.keyInvalid || c.keyErr != nil {
+		return false
+	}
+	for _, s := range c.Options.PublicScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireScope checks whether the client has the given scope. If it doesn't,
+// an error is written to the client and false is returned.
+func (c *Context) RequireScope(scope string) bool {
+	if c.HasScope(scope) {
+		return true
+	}
+	c.WriteHeader("Content-Type", "text/plain; charset=utf-8")
+	switch {
+	case c.keyErr != nil:
+		c.Err(c.keyErr)
+		c.Code(http.StatusInternalServerError)
+		c.Write([]byte("Could not check the API key"))
+	case c.keyInvalid:
+		c.Code(http.StatusUnauthorized)
+		c.Write([]byte("Invalid API key"))
+	case c.key == nil:
+		c.Code(http.StatusUnauthorized)
+		c.Write([]byte("An API key with the " + scope + " scope is required"))
+	default:
+		c.Code(http.StatusForbidden)
+		c.Write([]byte("The API key does not have the " + scope + " scope"))
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/osuripple/cheesegull/models"
+)
+
+func TestRequireScope(t *testing.T) {
+	public := Options{PublicScopes: []string{models.ScopeDownload}}
+	tt := []struct {
+		name    string
+		c       Context
+		scope   string
+		code    int
+		allowed bool
+	}{
+		{"public", Context{Options: public}, models.ScopeDownload, 200, true},
+		{"not public", Context{Options: public}, models.ScopeSearch, 401, false},
+		{"key", Context{key: &models.APIKey{Scopes: []string{models.ScopeSearch}}}, models.ScopeSearch, 200, true},
+		// keys don't get the public scopes.
+		{"key without scope", Context{Options: public, key: &models.APIKey{Scopes: []string{models.ScopeSearch}}}, models.ScopeDownload, 403, false},
+		{"admin", Context{key: &models.APIKey{Scopes: []string{models.ScopeAdmin}}}, models.ScopeDownloadUnranked, 200, true},
+		{"invalid key", Context{Options: public, keyInvalid: true}, models.ScopeDownload, 401, false},
+		{"error", Context{Options: public, keyErr: errors.New("db down")}, models.ScopeDownload, 500, false},
+	}
+	for _, tc := range tt {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tc.c.Request = httptest.NewRequest("GET", "/", nil)
+			tc.c.writer = w
+			tc.c.keyChecked = true
+			require.Equal(t, tc.allowed, tc.c.RequireScope(tc.scope))
+			require.Equal(t, tc.code, w.Code)
+		})
+	}
+}
+
+func TestSentAPIKey(t *testing.T) {
+	r := httptest.NewRequest("GET", "/d/1?key=query", nil)
+	c := &Context{Request: r}
+	require.Equal(t, "query", c.sentAPIKey())
+	r.Header.Set("X-API-Key", "header")
+	require.Equal(t, "header", c.sentAPIKey())
+}
+
+func TestAPIKeyCache(t *testing.T) {
+	var kc apiKeyCache
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	key := &models.APIKey{Name: "test"}
+	kc.put("valid", key, now)
+	// keys which don't exist are cached too.
+	kc.put("invalid", nil, now)
+
+	k, ok := kc.get("valid", now.Add(apiKeyTTL-time.Second))
+	require.True(t, ok)
+	require.Same(t, key, k)
+	k, ok = kc.get("invalid", now)
+	require.True(t, ok)
+	require.Nil(t, k)
+	_, ok = kc.get("valid", now.Add(apiKeyTTL))
+	require.False(t, ok)
+	_, ok = kc.get("unknown", now)
+	require.False(t, ok)
+
+	// once full, the expired keys are forgotten.
+	for i := len(kc.keys); i < maxCachedAPIKeys; i++ {
+		kc.put(strconv.Itoa(i), nil, now.Add(apiKeyTTL))
+	}
+	kc.put("new", nil, now.Add(apiKeyTTL))
+	require.Len(t, kc.keys, maxCachedAPIKeys-1)
+	_, ok = kc.get("valid", now)
+	require.False(t, ok)
+}
+
+func TestSentryHTTP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/d/1?key=secret&n=1", nil)
+	r.Header.Set("X-API-Key", "secret")
+	h := sentryHTTP(r)
+	require.NotContains(t, h.Query, "secret")
+	require.Contains(t, h.Query, "n=1")
+	require.NotContains(t, h.Headers["X-Api-Key"], "secret")
+}
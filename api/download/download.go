@@ -2,18 +2,33 @@
 package download
 
 import (
+	"bufio"
+	"context"
+	"database/sql"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net/http"
+	"os"
 	"strconv"
 	"time"
 
+	raven "github.com/getsentry/raven-go"
+
 	"github.com/osuripple/cheesegull/api"
 	"github.com/osuripple/cheesegull/downloader"
 	"github.com/osuripple/cheesegull/housekeeper"
+	"github.com/osuripple/cheesegull/metrics"
 	"github.com/osuripple/cheesegull/models"
 )
 
+var (
+	cacheRequests = metrics.NewCounter("cheesegull_cache_requests_total",
+		"Number of downloads of beatmaps, by whether they were already cached (hit) or not (miss).", "result")
+	cacheServedBytes = metrics.NewCounter("cheesegull_cache_served_bytes_total",
+		"Number of bytes of beatmaps sent to the clients, by whether they were already cached (hit) or not (miss).", "result")
+)
+
 func errorMessage(c *api.Context, code int, err string) {
 	c.WriteHeader("Content-Type", "text/plain; charset=utf-8")
 	c.Code(code)
@@ -25,13 +40,19 @@ func existsQueryKey(c *api.Context, s string) bool {
 	return ok
 }
 
-// Download is the handler for a request to download a beatmap
-func Download(c *api.Context) {
+// requestedSet fetches the set requested by the client, and makes sure it can
+// be downloaded. If it can't, an error is written to the client and nil is
+// returned.
+func requestedSet(c *api.Context) *models.Set {
+	if !c.RequireScope(models.ScopeDownload) {
+		return nil
+	}
+
 	// get the beatmap ID
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		errorMessage(c, 400, "Malformed ID")
-		return
+		return nil
 	}
 
 	// fetch beatmap set and make sure it exists.
@@ -39,76 +60,305 @@ func Download(c *api.Context) {
 	if err != nil {
 		c.Err(err)
 		errorMessage(c, 500, "Could not fetch set")
-		return
+		return nil
 	}
 	if set == nil {
 		errorMessage(c, 404, "Set not found")
-		return
+		return nil
 	}
-	if set.RankedStatus <= 0 && !c.Options.AllowUnranked {
+	if set.RankedStatus <= 0 && !c.Options.AllowUnranked && !c.HasScope(models.ScopeDownloadUnranked) {
 		errorMessage(c, 406, "Unranked beatmap sets are currently not available for download, following a warning")
+		return nil
+	}
+	return set
+}
+
+// wantsNoVideo checks whether the client wants the set without its video.
+// novideo is used only when we are requested to get a beatmap having a video
+// and novideo is in the request.
+func wantsNoVideo(c *api.Context, set *models.Set) bool {
+	return set.HasVideo && existsQueryKey(c, "novideo")
+}
+
+// Download is the handler for a request to download a beatmap
+func Download(c *api.Context) {
+	set := requestedSet(c)
+	if set == nil {
 		return
 	}
+	cbm := Acquire(c, set, wantsNoVideo(c, set))
+
+	c.House.Requested(cbm)
+
+	if !cbm.IsDownloaded() {
+		c.WriteHeader("X-Cache", "MISS")
+		cacheRequests.Inc("miss")
+		if answerQueued(c, set) {
+			return
+		}
+		streamBeatmap(c, set, cbm)
+		return
+	}
+	c.WriteHeader("X-Cache", "HIT")
+	cacheRequests.Inc("hit")
+
+	if cbm.FileSize() == 0 {
+		errorMessage(c, 504, "The beatmap could not be downloaded (probably got deleted from the osu! website)")
+		return
+	}
+
+	f, err := cbm.File(c.Request.Context())
+	if err != nil {
+		c.Err(err)
+		errorMessage(c, 500, "Internal error")
+		return
+	}
+	defer f.Close()
 
-	// use novideo only when we are requested to get a beatmap having a video
-	// and novideo is in the request
-	noVideo := set.HasVideo && existsQueryKey(c, "novideo")
+	serveFile(c, set, cbm, f)
+}
 
+// Acquire returns the beatmap of the set from the cache. If it is not cached
+// yet, or is outdated, its download is started in the background.
+func Acquire(c *api.Context, set *models.Set, noVideo bool) *housekeeper.CachedBeatmap {
 	cbm, shouldDownload := c.House.AcquireBeatmap(&housekeeper.CachedBeatmap{
-		ID:         id,
+		ID:         set.ID,
 		NoVideo:    noVideo,
 		LastUpdate: set.LastUpdate,
 	})
+	cbm.SetRankedStatus(set.RankedStatus)
 
 	if shouldDownload {
-		err := downloadBeatmap(c.DLClient, cbm, c.House)
+		// The download is carried on in the background, so that it is not
+		// interrupted if this client goes away while other requesters are
+		// still following it. It is cancelled only once everybody has gone
+		// away, or when CheeseGull shuts down.
+		ctx, cancel := context.WithTimeout(c.BackgroundContext(), downloadTimeout)
+		cbm.CancelWhenAbandoned(cancel)
+		// the download is queued right away, so that its position in the
+		// queue can be told to the client. Beatmaps without video are not
+		// queued: they are derived from the full ones, whose download is
+		// queued by openSource, and waiting for it while holding a place in
+		// the queue could leave it waiting forever.
+		queue := c.Options.Queue
+		if noVideo {
+			queue = nil
+		}
+		t := queue.Enqueue(set.ID)
+		// the request may be over by the time the download fails, so its
+		// logger and ID are taken now.
+		logger, requestID := c.Logger(), c.RequestID()
+		go func() {
+			defer cancel()
+			defer t.Release()
+			err := t.Wait(ctx)
+			if err != nil {
+				cbm.DownloadFailed(err, c.House)
+				return
+			}
+			err = downloadBeatmap(ctx, c, cbm)
+			if err != nil && ctx.Err() == nil {
+				logError(logger, requestID, "can't download set", err, "set_id", set.ID, "no_video", noVideo)
+			}
+		}()
+	}
+	return cbm
+}
+
+var envSentryDSN = os.Getenv("SENTRY_DSN")
+
+// logError logs an error of the work done in the background for a request to
+// Sentry and to logger. Unlike api.Context.Err, it does not read the request,
+// which may be over by then.
+func logError(logger *slog.Logger, requestID, msg string, err error, args ...any) {
+	if envSentryDSN != "" {
+		raven.CaptureError(err, map[string]string{"request_id": requestID})
+	}
+	logger.Error(msg, append(args, "err", err)...)
+}
+
+// serveFile writes the file of a cached beatmap to the client, honouring the
+// Range and If-Range headers so that interrupted downloads can be resumed.
+func serveFile(c *api.Context, set *models.Set, cbm *housekeeper.CachedBeatmap, f io.ReadSeeker) {
+	u := cbm.Usage()
+	size := u.FileSize
+	tag := etag(u.LastUpdate, size)
+
+	attachmentHeaders(c, set)
+	c.WriteHeader("Accept-Ranges", "bytes")
+	c.WriteHeader("ETag", tag)
+	if !u.LastUpdate.IsZero() {
+		c.WriteHeader("Last-Modified", u.LastUpdate.UTC().Format(http.TimeFormat))
+	}
+
+	var rng *httpRange
+	if ifRangeMatches(c.ReadHeader("If-Range"), tag, u.LastUpdate) {
+		var err error
+		rng, err = parseRange(c.ReadHeader("Range"), int64(size))
 		if err != nil {
-			c.Err(err)
-			errorMessage(c, 500, "Internal error")
+			c.WriteHeader("Content-Range", fmt.Sprintf("bytes */%d", size))
+			errorMessage(c, http.StatusRequestedRangeNotSatisfiable, "Requested range not satisfiable: "+err.Error())
 			return
 		}
-	} else {
-		cbm.MustBeDownloaded()
 	}
 
-	cbm.SetLastRequested(time.Now())
+	if rng == nil {
+		c.WriteHeader("Content-Length", strconv.FormatUint(size, 10))
+		c.Code(200)
+		n, err := io.Copy(c, f)
+		cacheServedBytes.Add(float64(n), "hit")
+		if err != nil {
+			c.Err(err)
+		}
+		return
+	}
 
-	if cbm.FileSize() == 0 {
-		errorMessage(c, 504, "The beatmap could not be downloaded (probably got deleted from the osu! website)")
+	if _, err := f.Seek(rng.start, io.SeekStart); err != nil {
+		c.Err(err)
+		errorMessage(c, 500, "Internal error")
 		return
 	}
+	c.WriteHeader("Content-Range", rng.contentRange(int64(size)))
+	c.WriteHeader("Content-Length", strconv.FormatInt(rng.length, 10))
+	c.Code(http.StatusPartialContent)
+	n, err := io.CopyN(c, f, rng.length)
+	cacheServedBytes.Add(float64(n), "hit")
+	if err != nil {
+		c.Err(err)
+	}
+}
 
-	f, err := cbm.File()
+// streamBeatmap sends a beatmap to the client while it is still being
+// downloaded. As the final size of the file is not known yet, Range requests
+// are not honoured.
+func streamBeatmap(c *api.Context, set *models.Set, cbm *housekeeper.CachedBeatmap) {
+	r, err := cbm.Stream(c.Request.Context())
 	if err != nil {
 		c.Err(err)
 		errorMessage(c, 500, "Internal error")
 		return
 	}
-	defer f.Close()
+	defer r.Close()
 
-	c.WriteHeader("Content-Type", "application/octet-stream")
-	c.WriteHeader("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("%d %s - %s.osz", set.ID, set.Artist, set.Title)))
-	c.WriteHeader("Content-Length", strconv.FormatUint(uint64(cbm.FileSize()), 10))
+	// Wait for the download to either start or fail before deciding what
+	// response we should give.
+	br := bufio.NewReader(r)
+	_, err = br.Peek(1)
+	switch {
+	case c.Request.Context().Err() != nil:
+		// the client went away.
+		return
+	case err == io.EOF:
+		errorMessage(c, 504, "The beatmap could not be downloaded (probably got deleted from the osu! website)")
+		return
+	case err != nil:
+		// the error is logged by the goroutine doing the download.
+		errorMessage(c, 500, "Internal error")
+		return
+	}
+
+	attachmentHeaders(c, set)
 	c.Code(200)
 
-	_, err = io.Copy(c, f)
+	n, err := io.Copy(c, br)
+	cacheServedBytes.Add(float64(n), "miss")
 	if err != nil {
-		c.Err(err)
+		// Either the client went away or the download failed midway. In the
+		// latter case, we must make sure the client doesn't mistake the
+		// truncated file for the whole one, so the response is aborted.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// Head is the handler for a HEAD request on a beatmap download. It tells
+// whether the beatmap is cached, and if so its size, without ever downloading
+// it.
+func Head(c *api.Context) {
+	set := requestedSet(c)
+	if set == nil {
+		return
+	}
+
+	attachmentHeaders(c, set)
+	c.WriteHeader("Last-Modified", set.LastUpdate.UTC().Format(http.TimeFormat))
+	c.WriteHeader("X-Has-Video", strconv.FormatBool(set.HasVideo))
+
+	cbm := c.House.Lookup(set.ID, wantsNoVideo(c, set))
+	var u housekeeper.BeatmapUsage
+	if cbm != nil {
+		u = cbm.Usage()
+	}
+	if cbm == nil || !cbm.IsDownloaded() || u.FileSize == 0 ||
+		u.LastUpdate.Before(set.LastUpdate) {
+		c.WriteHeader("X-Cache", "MISS")
+		queuePositionHeader(c, set)
+		c.Code(200)
+		return
+	}
+
+	size := u.FileSize
+	c.WriteHeader("X-Cache", "HIT")
+	c.WriteHeader("Accept-Ranges", "bytes")
+	c.WriteHeader("ETag", etag(u.LastUpdate, size))
+	c.WriteHeader("Content-Length", strconv.FormatUint(size, 10))
+	c.Code(200)
+}
+
+// queuedRetryAfter is how many seconds the clients whose download is queued
+// are told to wait before trying again.
+const queuedRetryAfter = 10
+
+// answerQueued answers 202 to the client if the download of the set is waiting
+// in the queue, rather than keeping it waiting without knowing its position,
+// and returns true. The download goes on in the background: the client can
+// follow its position with HEAD requests, and download the set once it is
+// cached.
+func answerQueued(c *api.Context, set *models.Set) bool {
+	pos := c.Options.Queue.Position(set.ID)
+	if pos <= 0 {
+		return false
 	}
+	c.WriteHeader("X-Queue-Position", strconv.Itoa(pos))
+	c.WriteHeader("Retry-After", strconv.Itoa(queuedRetryAfter))
+	errorMessage(c, http.StatusAccepted, fmt.Sprintf("The download of the set is queued, at position %d. Try again later.", pos))
+	return true
 }
 
-func downloadBeatmap(c downloader.Client, b *housekeeper.CachedBeatmap, house *housekeeper.House) error {
-	log.Println("[⬇️]", b.String())
+// queuePositionHeader tells the client the position of the download of the
+// set in the queue, if it is waiting to start.
+func queuePositionHeader(c *api.Context, set *models.Set) {
+	if pos := c.Options.Queue.Position(set.ID); pos > 0 {
+		c.WriteHeader("X-Queue-Position", strconv.Itoa(pos))
+	}
+}
+
+func attachmentHeaders(c *api.Context, set *models.Set) {
+	c.WriteHeader("Content-Type", "application/octet-stream")
+	c.WriteHeader("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("%d %s - %s.osz", set.ID, set.Artist, set.Title)))
+}
+
+// downloadTimeout is the maximum amount of time a download from the
+// providers may take.
+const downloadTimeout = time.Minute * 10
+
+// downloadBeatmap downloads a beatmap into the cache. As it runs in the
+// background, it must not use the request or the response in c.
+func downloadBeatmap(ctx context.Context, c *api.Context, b *housekeeper.CachedBeatmap) (err error) {
+	c.Logger().Info("downloading set", "set_id", b.ID, "no_video", b.NoVideo)
 
 	var fileSize uint64
 	defer func() {
 		// We need to wrap this inside a function because this way the arguments
 		// to DownloadCompleted are actually evaluated during the defer call.
-		b.DownloadCompleted(fileSize, house)
+		if err != nil {
+			b.DownloadFailed(err, c.House)
+			return
+		}
+		b.DownloadCompleted(fileSize, c.House)
 	}()
 
 	// Start downloading.
-	r, err := c.Download(b.ID, b.NoVideo)
+	r, err := openSource(ctx, c, b)
 	if err != nil {
 		if err == downloader.ErrNoRedirect {
 			return nil
@@ -118,7 +368,7 @@ func downloadBeatmap(c downloader.Client, b *housekeeper.CachedBeatmap, house *h
 	defer r.Close()
 
 	// open the file we will write the beatmap into
-	f, err := b.CreateFile()
+	f, err := b.CreateFile(ctx)
 	if err != nil {
 		return err
 	}
@@ -129,9 +379,120 @@ func downloadBeatmap(c downloader.Client, b *housekeeper.CachedBeatmap, house *h
 	if err != nil {
 		return err
 	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if c.Options.Verify != downloader.VerifyOff {
+		return verifyBeatmap(ctx, c, b)
+	}
+	return nil
+}
+
+// openSource returns the contents of a beatmap to be written into the cache.
+// Full beatmaps are downloaded from the providers, while the ones without video
+// are derived from the full ones, as not all providers can strip the videos.
+func openSource(ctx context.Context, c *api.Context, b *housekeeper.CachedBeatmap) (io.ReadCloser, error) {
+	if !b.NoVideo {
+		return c.DLClient.Download(ctx, b.ID, false)
+	}
+
+	u := b.Usage()
+	full, shouldDownload := c.House.AcquireBeatmap(&housekeeper.CachedBeatmap{
+		ID:         b.ID,
+		LastUpdate: u.LastUpdate,
+	})
+	full.SetRankedStatus(u.RankedStatus)
+	c.House.Requested(full)
+	if shouldDownload {
+		// the full beatmap is useful on its own, so its download goes on
+		// even if everybody waiting for the one without video goes away.
+		fctx, cancel := context.WithTimeout(c.BackgroundContext(), downloadTimeout)
+		defer cancel()
+		t, err := c.Options.Queue.Acquire(fctx, b.ID)
+		if err != nil {
+			full.DownloadFailed(err, c.House)
+			return nil, err
+		}
+		err = downloadBeatmap(fctx, c, full)
+		t.Release()
+		if err != nil {
+			return nil, err
+		}
+	} else if err := full.WaitDownloaded(ctx); err != nil {
+		return nil, err
+	}
+	if full.FileSize() == 0 {
+		return nil, downloader.ErrNoRedirect
+	}
+
+	f, err := full.File(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		err := downloader.StripVideo(pw, f, fi.Size())
+		f.Close()
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// verifyBeatmap verifies a beatmap downloaded for a request, following
+// c.Options.Verify.
+func verifyBeatmap(ctx context.Context, c *api.Context, b *housekeeper.CachedBeatmap) error {
+	return VerifyBeatmap(ctx, c.DB, c.Options.Verify, c.Logger(), b)
+}
+
+// VerifyBeatmap checks the contents of a downloaded beatmap against the MD5s
+// of the beatmaps in its set, and stores the result in the CachedBeatmap. If
+// mode is VerifyReject and the beatmap does not match, an error is returned.
+func VerifyBeatmap(ctx context.Context, db *sql.DB, mode downloader.VerifyMode, logger *slog.Logger, b *housekeeper.CachedBeatmap) error {
+	set, err := models.FetchSet(db, b.ID, true)
+	if err != nil || set == nil {
+		// we can't know what to verify against: leave the beatmap
+		// unverified.
+		return err
+	}
+	md5s := make([]string, len(set.ChildrenBeatmaps))
+	for i, bm := range set.ChildrenBeatmaps {
+		md5s[i] = bm.FileMD5
+	}
+
+	f, err := b.File(ctx)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	res, err := downloader.Verify(f, fi.Size(), md5s)
+	if err == nil && res.OK() {
+		b.SetVerification(housekeeper.VerificationPassed)
+		return nil
+	}
+	b.SetVerification(housekeeper.VerificationFailed)
+	if err == nil {
+		err = fmt.Errorf("archive does not match: %s", res)
+	}
+	logger.Warn("verification failed", "set_id", b.ID, "no_video", b.NoVideo, "err", err)
+	if mode == downloader.VerifyReject {
+		return fmt.Errorf("cheesegull/download: rejecting %s: %w", b, err)
+	}
 	return nil
 }
 
 func init() {
 	api.GET("/d/:id", Download)
+	api.HEAD("/d/:id", Head)
 }
@@ -0,0 +1,57 @@
+package download
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/osuripple/cheesegull/api"
+	"github.com/osuripple/cheesegull/housekeeper"
+	"github.com/osuripple/cheesegull/models"
+)
+
+// failingClient fails the test if anything is downloaded.
+type failingClient struct{ t *testing.T }
+
+func (c failingClient) Download(ctx context.Context, setID int, noVideo bool) (io.ReadCloser, error) {
+	c.t.Errorf("set %d downloaded", setID)
+	return nil, errors.New("no downloads expected")
+}
+
+func TestAcquireAdopted(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "1.osz"))
+	require.NoError(t, err)
+	zw := zip.NewWriter(f)
+	_, err = zw.Create("beatmap.osu")
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	require.NoError(t, f.Close())
+	written := time.Date(2020, 4, 5, 15, 5, 3, 0, time.UTC)
+	require.NoError(t, os.Chtimes(f.Name(), written, written))
+
+	h := housekeeper.New(filepath.Join(t.TempDir(), "cgbin.db"))
+	h.Storage = housekeeper.LocalStorage(dir)
+	_, err = h.Reconcile()
+	require.NoError(t, err)
+
+	// the set was last updated before its file was written: the adopted
+	// file is served as it is.
+	c := &api.Context{House: h, DLClient: failingClient{t}}
+	set := &models.Set{ID: 1, RankedStatus: 1, LastUpdate: written.Add(-time.Hour)}
+	cbm := Acquire(c, set, false)
+	require.True(t, cbm.IsDownloaded())
+	file, err := cbm.File(context.Background())
+	require.NoError(t, err)
+	defer file.Close()
+	fi, err := file.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(cbm.FileSize()), fi.Size())
+}
@@ -0,0 +1,27 @@
+package download
+
+import (
+	"github.com/osuripple/cheesegull/api"
+	"github.com/osuripple/cheesegull/downloader"
+)
+
+type statuser interface {
+	Status() []downloader.ProviderStatus
+}
+
+// Providers shows the status of the download providers, alongside with the
+// state of their circuit breakers.
+func Providers(c *api.Context) {
+	var status []downloader.ProviderStatus
+	if s, ok := c.DLClient.(statuser); ok {
+		status = s.Status()
+	}
+	if status == nil {
+		status = []downloader.ProviderStatus{}
+	}
+	c.WriteJSON(200, status)
+}
+
+func init() {
+	api.GET("/api/providers", Providers)
+}
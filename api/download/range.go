@@ -0,0 +1,114 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errMultipleRanges = errors.New("multiple ranges are not supported")
+	errInvalidRange   = errors.New("invalid range")
+	errNoOverlap      = errors.New("range does not overlap with the file")
+)
+
+// httpRange is a single byte range requested through the Range header.
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses the value of a Range header, knowing the full size of the
+// file. A nil range and a nil error mean that the whole file should be served.
+// Only a single range is supported: asking for more than one will return
+// errMultipleRanges.
+func parseRange(s string, size int64) (*httpRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		// RFC 7233: range units we don't understand must be ignored.
+		return nil, nil
+	}
+	spec := strings.TrimSpace(s[len(b):])
+	if strings.Contains(spec, ",") {
+		return nil, errMultipleRanges
+	}
+	i := strings.IndexByte(spec, '-')
+	if i < 0 {
+		return nil, errInvalidRange
+	}
+	start, end := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+	var r httpRange
+	if start == "" {
+		// suffix range: "-500" means the last 500 bytes.
+		n, err := strconv.ParseInt(end, 10, 64)
+		if err != nil || n < 0 {
+			return nil, errInvalidRange
+		}
+		if n == 0 || size == 0 {
+			return nil, errNoOverlap
+		}
+		if n > size {
+			n = size
+		}
+		r.start = size - n
+		r.length = n
+		return &r, nil
+	}
+
+	i64, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || i64 < 0 {
+		return nil, errInvalidRange
+	}
+	if i64 >= size {
+		return nil, errNoOverlap
+	}
+	r.start = i64
+	if end == "" {
+		// open range: "500-" means everything from byte 500 onwards.
+		r.length = size - r.start
+		return &r, nil
+	}
+	i64, err = strconv.ParseInt(end, 10, 64)
+	if err != nil || i64 < r.start {
+		return nil, errInvalidRange
+	}
+	if i64 >= size {
+		i64 = size - 1
+	}
+	r.length = i64 - r.start + 1
+	return &r, nil
+}
+
+// etag creates a strong entity tag for a cached file, knowing when the
+// beatmap set was last updated and the size of the file.
+func etag(lastUpdate time.Time, size uint64) string {
+	return fmt.Sprintf(`"%x-%x"`, lastUpdate.Unix(), size)
+}
+
+// ifRangeMatches checks whether the If-Range header, if any, allows the Range
+// header to be honoured. If-Range may contain either an entity tag, which must
+// match strongly, or a date, which must be exactly the Last-Modified date.
+func ifRangeMatches(ifRange, etag string, lastModified time.Time) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		// weak entity tags can never match in If-Range.
+		return ifRange == etag
+	}
+	t, err := http.ParseTime(ifRange)
+	if err != nil || lastModified.IsZero() {
+		return false
+	}
+	return t.Equal(lastModified.Truncate(time.Second))
+}
@@ -0,0 +1,54 @@
+package download
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		size   int64
+		exp    *httpRange
+		err    error
+	}{
+		{"", 1000, nil, nil},
+		{"items=0-5", 1000, nil, nil},
+		{"bytes=0-499", 1000, &httpRange{0, 500}, nil},
+		{"bytes=500-", 1000, &httpRange{500, 500}, nil},
+		{"bytes=-200", 1000, &httpRange{800, 200}, nil},
+		{"bytes=-2000", 1000, &httpRange{0, 1000}, nil},
+		{"bytes=900-5000", 1000, &httpRange{900, 100}, nil},
+		{"bytes= 10-19", 1000, &httpRange{10, 10}, nil},
+
+		{"bytes=0-1,5-6", 1000, nil, errMultipleRanges},
+		{"bytes=1000-", 1000, nil, errNoOverlap},
+		{"bytes=-0", 1000, nil, errNoOverlap},
+		{"bytes=5-1", 1000, nil, errInvalidRange},
+		{"bytes=abc", 1000, nil, errInvalidRange},
+		{"bytes=a-b", 1000, nil, errInvalidRange},
+	} {
+		t.Run(tc.header, func(t *testing.T) {
+			r, err := parseRange(tc.header, tc.size)
+			require.Equal(t, tc.err, err)
+			require.Equal(t, tc.exp, r)
+		})
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	lastUpdate := time.Date(2017, 9, 21, 11, 11, 50, 0, time.UTC)
+	tag := etag(lastUpdate, 58111)
+
+	require.True(t, ifRangeMatches("", tag, lastUpdate))
+	require.True(t, ifRangeMatches(tag, tag, lastUpdate))
+	require.True(t, ifRangeMatches(lastUpdate.Format(http.TimeFormat), tag, lastUpdate))
+
+	require.False(t, ifRangeMatches("W/"+tag, tag, lastUpdate))
+	require.False(t, ifRangeMatches(etag(lastUpdate, 58112), tag, lastUpdate))
+	require.False(t, ifRangeMatches(lastUpdate.Add(time.Hour).Format(http.TimeFormat), tag, lastUpdate))
+	require.False(t, ifRangeMatches("garbage", tag, lastUpdate))
+}
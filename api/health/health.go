@@ -0,0 +1,184 @@
+// Package health handles the requests made by load balancers and monitoring
+// to find out whether CheeseGull is alive, and whether it is ready to serve
+// requests.
+package health
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/osuripple/cheesegull/api"
+	"github.com/osuripple/cheesegull/downloader"
+	"github.com/osuripple/cheesegull/housekeeper"
+	"github.com/osuripple/cheesegull/models"
+)
+
+// checkTimeout is how long every check of Ready may take before it is
+// considered failed.
+const checkTimeout = time.Second * 2
+
+var errNotConfigured = errors.New("not configured")
+
+// Check is the result of checking one of the things CheeseGull depends on.
+type Check struct {
+	OK        bool
+	Error     string `json:",omitempty"`
+	LatencyMS float64
+}
+
+// ProvidersCheck is the result of checking the download providers.
+type ProvidersCheck struct {
+	Check
+	Providers []downloader.ProviderStatus `json:",omitempty"`
+}
+
+// SetsCheck is the result of checking whether the set updater keeps the sets
+// in the database up-to-date.
+type SetsCheck struct {
+	Check
+	NewestLastChecked time.Time
+	// StalenessSeconds is how long ago NewestLastChecked was, and
+	// MaxStalenessSeconds the most it may be for the sets to be fresh.
+	StalenessSeconds    float64
+	MaxStalenessSeconds float64 `json:",omitempty"`
+}
+
+// Readiness is the breakdown of the checks done by Ready.
+type Readiness struct {
+	Ready     bool
+	MySQL     Check
+	Search    Check
+	Providers ProvidersCheck
+	Storage   Check
+	Sets      SetsCheck
+}
+
+// result returns the Check of something checked since start, which failed if
+// err is not nil.
+func result(start time.Time, err error) Check {
+	c := Check{
+		OK:        err == nil,
+		LatencyMS: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	return c
+}
+
+func ping(ctx context.Context, db *sql.DB) Check {
+	start := time.Now()
+	if db == nil {
+		return result(start, errNotConfigured)
+	}
+	return result(start, db.PingContext(ctx))
+}
+
+func checkStorage(ctx context.Context, h *housekeeper.House) Check {
+	start := time.Now()
+	if h == nil {
+		return result(start, errNotConfigured)
+	}
+	return result(start, h.CheckStorage(ctx))
+}
+
+type statuser interface {
+	Status() []downloader.ProviderStatus
+}
+
+type availabler interface {
+	Available() bool
+}
+
+func checkProviders(dlc downloader.Client) ProvidersCheck {
+	start := time.Now()
+	if dlc == nil {
+		return ProvidersCheck{Check: result(start, errNotConfigured)}
+	}
+	var res ProvidersCheck
+	if s, ok := dlc.(statuser); ok {
+		res.Providers = s.Status()
+	}
+	var err error
+	if av, ok := dlc.(availabler); ok && !av.Available() {
+		err = downloader.ErrNoProvider
+	}
+	res.Check = result(start, err)
+	return res
+}
+
+func checkSets(ctx context.Context, db *sql.DB, maxStaleness time.Duration) SetsCheck {
+	start := time.Now()
+	res := SetsCheck{MaxStalenessSeconds: maxStaleness.Seconds()}
+	if db == nil {
+		res.Check = result(start, errNotConfigured)
+		return res
+	}
+	newest, err := models.NewestLastChecked(ctx, db)
+	switch {
+	case err != nil:
+	case newest.IsZero():
+		err = errors.New("there are no sets in the database")
+	default:
+		staleness := time.Since(newest)
+		res.NewestLastChecked = newest
+		res.StalenessSeconds = staleness.Seconds()
+		if maxStaleness > 0 && staleness > maxStaleness {
+			err = fmt.Errorf("the sets have not been updated for %v", staleness.Round(time.Second))
+		}
+	}
+	res.Check = result(start, err)
+	return res
+}
+
+// Healthz tells whether the process is alive. It does not check anything
+// else, so that CheeseGull is not restarted when MySQL is down.
+func Healthz(c *api.Context) {
+	c.WriteHeader("Content-Type", "text/plain; charset=utf-8")
+	c.Write([]byte("ok"))
+}
+
+// Ready checks the connections to MySQL and to the search database, whether
+// any download provider is available, whether the storage of the cache is
+// writable and whether the sets in the database are being updated. It answers
+// with 503 if any of them fails.
+func Ready(c *api.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), checkTimeout)
+	defer cancel()
+
+	var (
+		r  Readiness
+		wg sync.WaitGroup
+	)
+	checks := []func(){
+		func() { r.MySQL = ping(ctx, c.DB) },
+		func() { r.Search = ping(ctx, c.SearchDB) },
+		func() { r.Providers = checkProviders(c.DLClient) },
+		func() { r.Storage = checkStorage(ctx, c.House) },
+		func() { r.Sets = checkSets(ctx, c.DB, c.Options.ReadyMaxStaleness) },
+	}
+	wg.Add(len(checks))
+	for _, check := range checks {
+		go func(check func()) {
+			defer wg.Done()
+			check()
+		}(check)
+	}
+	wg.Wait()
+
+	r.Ready = r.MySQL.OK && r.Search.OK && r.Providers.OK && r.Storage.OK && r.Sets.OK
+	code := 200
+	if !r.Ready {
+		code = 503
+	}
+	c.WriteJSON(code, r)
+}
+
+func init() {
+	api.GET("/healthz", Healthz)
+	api.GET("/readyz", Ready)
+}
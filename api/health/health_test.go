@@ -0,0 +1,41 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/osuripple/cheesegull/api"
+	"github.com/osuripple/cheesegull/housekeeper"
+)
+
+func TestHealthz(t *testing.T) {
+	h := api.CreateHandler(nil, nil, nil, nil, api.Options{})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "ok", w.Body.String())
+}
+
+func TestReady(t *testing.T) {
+	dir := t.TempDir()
+	house := housekeeper.New(filepath.Join(dir, "cgbin.db"))
+	house.Storage = housekeeper.LocalStorage(filepath.Join(dir, "data"))
+
+	h := api.CreateHandler(nil, nil, house, nil, api.Options{})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	require.Equal(t, 503, w.Code)
+
+	var r Readiness
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &r))
+	require.False(t, r.Ready)
+	require.True(t, r.Storage.OK, r.Storage.Error)
+	require.False(t, r.MySQL.OK)
+	require.Equal(t, "not configured", r.Search.Error)
+	require.False(t, r.Providers.OK)
+	require.False(t, r.Sets.OK)
+}
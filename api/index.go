@@ -1,7 +1,7 @@
 package api
 
 import (
-	"expvar"
+	"github.com/osuripple/cheesegull/metrics"
 )
 
 // Version is set by main and it is given to requests at /
@@ -12,13 +12,14 @@ func index(c *Context) {
 	c.Write([]byte("CheeseGull " + Version + " Woo\nFor more information: https://github.com/osuripple/cheesegull"))
 }
 
-var _evh = expvar.Handler()
-
-func expvarHandler(c *Context) {
-	_evh.ServeHTTP(c.writer, c.Request)
+func metricsHandler(c *Context) {
+	c.WriteHeader("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := metrics.Default.WriteTo(c); err != nil {
+		c.Err(err)
+	}
 }
 
 func init() {
 	GET("/", index)
-	GET("/expvar", expvarHandler)
+	GET("/metrics", metricsHandler)
 }
@@ -0,0 +1,19 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	h := CreateHandler(nil, nil, nil, nil, Options{})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, 200, w.Code)
+	require.Contains(t, w.Body.String(), `cheesegull_http_requests_total{route="/",method="GET",code="200"} 1`+"\n")
+	require.Contains(t, w.Body.String(), `cheesegull_http_request_duration_seconds_count{route="/"} 1`+"\n")
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// requestID returns the ID of a request: the one in its X-Request-ID header if
+// it has a sensible one, as set by a reverse proxy, or else a new random one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); validRequestID(id) {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// finishRequest logs a request and records its metrics, once it has been
+// handled.
+func finishRequest(c *Context, w *countingWriter, start time.Time) {
+	duration := time.Since(start)
+	code := w.code
+	if code == 0 {
+		// net/http answers 200 when the handler writes nothing.
+		code = http.StatusOK
+	}
+	observeRequest(c.route, c.Request.Method, code, w.n, duration)
+
+	level := slog.LevelInfo
+	if code >= 500 {
+		level = slog.LevelWarn
+	}
+	c.Logger().LogAttrs(c.Request.Context(), level, "request",
+		slog.String("method", c.Request.Method),
+		slog.String("path", c.Request.URL.Path),
+		slog.String("route", c.route),
+		slog.Int("status", code),
+		slog.Int64("bytes", w.n),
+		slog.Duration("duration", duration),
+	)
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	h := CreateHandler(nil, nil, nil, nil, Options{
+		Logger: slog.New(slog.NewJSONHandler(buf, nil)),
+	})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Request-ID", "abc-123")
+	r.RemoteAddr = "1.2.3.4:5000"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, "abc-123", w.Header().Get("X-Request-ID"))
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.Equal(t, "request", entry["msg"])
+	require.Equal(t, "abc-123", entry["request_id"])
+	require.Equal(t, "1.2.3.4", entry["client_ip"])
+	require.Equal(t, "/", entry["route"])
+	require.Equal(t, float64(200), entry["status"])
+	require.Equal(t, float64(w.Body.Len()), entry["bytes"])
+
+	// IDs which could mess up the logs are replaced.
+	r.Header.Set("X-Request-ID", "abc\n123")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Len(t, w.Header().Get("X-Request-ID"), 16)
+}
@@ -12,6 +12,9 @@ import (
 
 // Beatmap handles requests to retrieve single beatmaps.
 func Beatmap(c *api.Context) {
+	if !c.RequireScope(models.ScopeSearch) {
+		return
+	}
 	id, _ := strconv.Atoi(strings.TrimSuffix(c.Param("id"), ".json"))
 	if id == 0 {
 		c.WriteJSON(404, nil)
@@ -34,6 +37,9 @@ func Beatmap(c *api.Context) {
 
 // Set handles requests to retrieve single beatmap sets.
 func Set(c *api.Context) {
+	if !c.RequireScope(models.ScopeSearch) {
+		return
+	}
 	id, _ := strconv.Atoi(strings.TrimSuffix(c.Param("id"), ".json"))
 	if id == 0 {
 		c.WriteJSON(404, nil)
@@ -93,6 +99,9 @@ func sIntWithBounds(strs []string, min, max int) []int {
 
 // Search does a search on the sets available in the database.
 func Search(c *api.Context) {
+	if !c.RequireScope(models.ScopeSearch) {
+		return
+	}
 	query := c.Request.URL.Query()
 	sets, err := models.SearchSets(c.DB, c.SearchDB, models.SearchOptions{
 		Status: sIntWithBounds(query["status"], -2, 4),
@@ -0,0 +1,25 @@
+package api
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/osuripple/cheesegull/metrics"
+)
+
+var (
+	requestsTotal = metrics.NewCounter("cheesegull_http_requests_total",
+		"Number of HTTP requests handled, by route, method and status code.", "route", "method", "code")
+	requestDuration = metrics.NewHistogram("cheesegull_http_request_duration_seconds",
+		"Time taken to handle HTTP requests, by route. Downloads take as long as sending the whole beatmap.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}, "route")
+	responseBytes = metrics.NewCounter("cheesegull_http_response_bytes_total",
+		"Number of bytes written in the bodies of HTTP responses, by route.", "route")
+)
+
+// observeRequest records the metrics of a request, once it has been handled.
+func observeRequest(route, method string, code int, bytes int64, duration time.Duration) {
+	requestsTotal.Inc(route, method, strconv.Itoa(code))
+	requestDuration.Observe(duration.Seconds(), route)
+	responseBytes.Add(float64(bytes), route)
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Middleware wraps the handler of a request. It can do something before or
+// after calling next, or answer the request by itself without calling it.
+type Middleware func(next func(c *Context)) func(c *Context)
+
+// chain wraps f with the middlewares. The first middleware is the outermost
+// one, and is thus the first to see the request.
+func chain(f func(c *Context), mws []Middleware) func(c *Context) {
+	for i := len(mws) - 1; i >= 0; i-- {
+		f = mws[i](f)
+	}
+	return f
+}
+
+// Route returns the path with which the handler of the request was
+// registered, such as /d/:id.
+func (c *Context) Route() string {
+	return c.route
+}
+
+// ClientIP returns the IP address of the client. If the request comes from one
+// of Options.TrustedProxies, the address is taken from X-Forwarded-For
+// instead, skipping the trusted proxies the request went through.
+func (c *Context) ClientIP() string {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		host = c.Request.RemoteAddr
+	}
+	if !c.trustedProxy(net.ParseIP(host)) {
+		return host
+	}
+
+	// every proxy appends the address it received the request from, so the
+	// client is the last address which is not a trusted proxy.
+	var forwarded []string
+	for _, h := range c.Request.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(h, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		host = ip.String()
+		if !c.trustedProxy(ip) {
+			break
+		}
+	}
+	return host
+}
+
+func (c *Context) trustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.Options.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTrustedProxies parses a list of IP addresses and networks in CIDR
+// notation, to be used as Options.TrustedProxies.
+func ParseTrustedProxies(l []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(l))
+	for _, s := range l {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: s}
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// countingWriter is a http.ResponseWriter counting the bytes written to the
+// response body, and recording the status code of the response.
+type countingWriter struct {
+	http.ResponseWriter
+	n    int64
+	code int
+}
+
+func (w *countingWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "::1"})
+	require.NoError(t, err)
+	_, err = ParseTrustedProxies([]string{"not an ip"})
+	require.Error(t, err)
+
+	tt := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		ip         string
+	}{
+		{"direct", "1.2.3.4:5000", nil, "1.2.3.4"},
+		{"untrusted proxy", "1.2.3.4:5000", []string{"5.6.7.8"}, "1.2.3.4"},
+		{"trusted proxy", "10.0.0.1:5000", []string{"5.6.7.8"}, "5.6.7.8"},
+		{"ipv6 proxy", "[::1]:5000", []string{"5.6.7.8"}, "5.6.7.8"},
+		{"spoofed", "10.0.0.1:5000", []string{"9.9.9.9, 5.6.7.8"}, "5.6.7.8"},
+		{"proxy chain", "10.0.0.1:5000", []string{"5.6.7.8", "10.0.0.2"}, "5.6.7.8"},
+		{"invalid", "10.0.0.1:5000", []string{"5.6.7.8, garbage"}, "10.0.0.1"},
+		{"no header", "10.0.0.1:5000", nil, "10.0.0.1"},
+	}
+	for _, tc := range tt {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for _, h := range tc.xff {
+				r.Header.Add("X-Forwarded-For", h)
+			}
+			c := &Context{Request: r, Options: Options{TrustedProxies: proxies}}
+			require.Equal(t, tc.ip, c.ClientIP())
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	mw := func(name string) Middleware {
+		return func(next func(c *Context)) func(c *Context) {
+			return func(c *Context) {
+				calls = append(calls, name)
+				next(c)
+			}
+		}
+	}
+	f := chain(func(c *Context) { calls = append(calls, "handler") }, []Middleware{mw("a"), mw("b")})
+	f(&Context{})
+	require.Equal(t, []string{"a", "b", "handler"}, calls)
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The routes whose requests are limited by RateLimit.
+const (
+	searchRoute   = "/api/search"
+	downloadRoute = "/d/:id"
+)
+
+// RateLimit limits how many searches every client may do, and how many bytes
+// of beatmaps it may download. Clients are identified by their API key, or by
+// their IP if they have none. Clients over their limit get a 429 response,
+// with a Retry-After header telling them when to try again.
+//
+// The limits are enforced with token buckets: the budget of a client is
+// refilled over time, so that a client which used it all can't just wait for
+// the start of a new day to use it all again at once.
+type RateLimit struct {
+	// SearchesPerMinute is the number of searches a client may do every
+	// minute. 0 means unlimited.
+	SearchesPerMinute int
+	// DownloadBytesPerDay is the number of bytes of beatmaps a client may
+	// download every day. 0 means unlimited. As the size of a beatmap is not
+	// always known before sending it, a download is refused only once the
+	// budget has already been used up.
+	DownloadBytesPerDay int64
+
+	mtx       sync.Mutex
+	clients   map[string]*clientBudget
+	lastPrune time.Time
+	// now returns the current time. It is replaced in tests.
+	now func() time.Time
+}
+
+type clientBudget struct {
+	searches  bucket
+	downloads bucket
+}
+
+// bucket is a token bucket, refilled at a constant rate up to its capacity.
+// A new bucket is full.
+type bucket struct {
+	used    float64
+	updated time.Time
+}
+
+// refill updates the bucket to now, and returns the tokens in it.
+func (b *bucket) refill(now time.Time, capacity float64, period time.Duration) float64 {
+	if !b.updated.IsZero() {
+		b.used -= capacity * float64(now.Sub(b.updated)) / float64(period)
+		if b.used < 0 {
+			b.used = 0
+		}
+	}
+	b.updated = now
+	return capacity - b.used
+}
+
+// wait returns how long it takes for the bucket to have n tokens.
+func (b *bucket) wait(n, capacity float64, period time.Duration) time.Duration {
+	missing := n - (capacity - b.used)
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / capacity * float64(period))
+}
+
+// pruneEvery is how often the clients whose budget is full again are
+// forgotten.
+const pruneEvery = time.Minute * 10
+
+func (l *RateLimit) budget(key string, now time.Time) *clientBudget {
+	if l.clients == nil {
+		l.clients = make(map[string]*clientBudget)
+		l.lastPrune = now
+	}
+	if now.Sub(l.lastPrune) >= pruneEvery {
+		for k, b := range l.clients {
+			if b.searches.refill(now, float64(l.SearchesPerMinute), time.Minute) >= float64(l.SearchesPerMinute) &&
+				b.downloads.refill(now, float64(l.DownloadBytesPerDay), time.Hour*24) >= float64(l.DownloadBytesPerDay) {
+				delete(l.clients, k)
+			}
+		}
+		l.lastPrune = now
+	}
+	b := l.clients[key]
+	if b == nil {
+		b = &clientBudget{}
+		l.clients[key] = b
+	}
+	return b
+}
+
+func (l *RateLimit) clock() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// Middleware is the Middleware enforcing the limits.
+func (l *RateLimit) Middleware(next func(c *Context)) func(c *Context) {
+	return func(c *Context) {
+		var (
+			search   = c.Route() == searchRoute && l.SearchesPerMinute > 0
+			download = c.Route() == downloadRoute && c.Request.Method == "GET" && l.DownloadBytesPerDay > 0
+		)
+		if !search && !download {
+			next(c)
+			return
+		}
+
+		key := "ip:" + c.ClientIP()
+		if k := c.APIKey(); k != nil {
+			key = "key:" + strconv.Itoa(k.ID)
+		}
+
+		var wait time.Duration
+		l.mtx.Lock()
+		now := l.clock()
+		b := l.budget(key, now)
+		if search {
+			capacity := float64(l.SearchesPerMinute)
+			if b.searches.refill(now, capacity, time.Minute) >= 1 {
+				b.searches.used++
+			} else {
+				wait = b.searches.wait(1, capacity, time.Minute)
+			}
+		}
+		if download {
+			capacity := float64(l.DownloadBytesPerDay)
+			if b.downloads.refill(now, capacity, time.Hour*24) <= 0 {
+				wait = b.downloads.wait(1, capacity, time.Hour*24)
+			}
+		}
+		l.mtx.Unlock()
+
+		if wait > 0 {
+			c.WriteHeader("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.WriteHeader("Content-Type", "text/plain; charset=utf-8")
+			c.Code(http.StatusTooManyRequests)
+			c.Write([]byte("Too many requests, slow down"))
+			return
+		}
+		if !download {
+			next(c)
+			return
+		}
+
+		w := &countingWriter{ResponseWriter: c.writer}
+		c.writer = w
+		defer func() {
+			// the bytes are counted even if the download was aborted.
+			l.mtx.Lock()
+			now := l.clock()
+			b := l.budget(key, now)
+			b.downloads.refill(now, float64(l.DownloadBytesPerDay), time.Hour*24)
+			b.downloads.used += float64(w.n)
+			l.mtx.Unlock()
+		}()
+		next(c)
+	}
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/osuripple/cheesegull/models"
+)
+
+func (l *RateLimit) serve(route, remoteAddr string, body int) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/whatever", nil)
+	r.RemoteAddr = remoteAddr
+	c := &Context{
+		Request:    r,
+		writer:     w,
+		route:      route,
+		keyChecked: true,
+	}
+	if remoteAddr == "key" {
+		r.RemoteAddr = "1.2.3.4:5000"
+		c.key = &models.APIKey{ID: 1}
+	}
+	l.Middleware(func(c *Context) {
+		c.Write(make([]byte, body))
+	})(c)
+	return w
+}
+
+func TestRateLimitSearch(t *testing.T) {
+	now := time.Date(2020, 4, 5, 15, 5, 3, 0, time.UTC)
+	l := &RateLimit{SearchesPerMinute: 2, now: func() time.Time { return now }}
+
+	require.Equal(t, 200, l.serve(searchRoute, "1.2.3.4:5000", 0).Code)
+	require.Equal(t, 200, l.serve(searchRoute, "1.2.3.4:5000", 0).Code)
+	w := l.serve(searchRoute, "1.2.3.4:5000", 0)
+	require.Equal(t, 429, w.Code)
+	require.Equal(t, "30", w.Header().Get("Retry-After"))
+
+	// other clients and other routes are not affected.
+	require.Equal(t, 200, l.serve(searchRoute, "5.6.7.8:5000", 0).Code)
+	require.Equal(t, 200, l.serve(searchRoute, "key", 0).Code)
+	require.Equal(t, 200, l.serve("/api/s/:id", "1.2.3.4:5000", 0).Code)
+
+	now = now.Add(time.Second * 30)
+	require.Equal(t, 200, l.serve(searchRoute, "1.2.3.4:5000", 0).Code)
+	require.Equal(t, 429, l.serve(searchRoute, "1.2.3.4:5000", 0).Code)
+}
+
+func TestRateLimitDownloads(t *testing.T) {
+	now := time.Date(2020, 4, 5, 15, 5, 3, 0, time.UTC)
+	l := &RateLimit{DownloadBytesPerDay: 24000, now: func() time.Time { return now }}
+
+	// the download exceeding the budget is still served...
+	require.Equal(t, 200, l.serve(downloadRoute, "1.2.3.4:5000", 15000).Code)
+	require.Equal(t, 200, l.serve(downloadRoute, "1.2.3.4:5000", 15000).Code)
+	// ...but not the ones after it.
+	w := l.serve(downloadRoute, "1.2.3.4:5000", 15000)
+	require.Equal(t, 429, w.Code)
+	require.Equal(t, "21604", w.Header().Get("Retry-After"))
+	require.Equal(t, 200, l.serve(downloadRoute, "key", 15000).Code)
+
+	now = now.Add(time.Hour * 6)
+	require.Equal(t, 429, l.serve(downloadRoute, "1.2.3.4:5000", 15000).Code)
+	now = now.Add(time.Second * 4)
+	require.Equal(t, 200, l.serve(downloadRoute, "1.2.3.4:5000", 15000).Code)
+
+	// clients are forgotten once their budget is full again.
+	now = now.Add(time.Hour * 48)
+	l.serve(downloadRoute, "5.6.7.8:5000", 0)
+	require.Len(t, l.clients, 1)
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/kingpin"
@@ -13,13 +20,17 @@ import (
 	osuapi "github.com/thehowl/go-osuapi"
 
 	"github.com/osuripple/cheesegull/api"
+	"github.com/osuripple/cheesegull/api/download"
 	"github.com/osuripple/cheesegull/dbmirror"
 	"github.com/osuripple/cheesegull/downloader"
 	"github.com/osuripple/cheesegull/housekeeper"
+	"github.com/osuripple/cheesegull/metrics"
 	"github.com/osuripple/cheesegull/models"
+	"github.com/osuripple/cheesegull/prefetch"
 
 	// Components of the API we want to use
-	_ "github.com/osuripple/cheesegull/api/download"
+	_ "github.com/osuripple/cheesegull/api/admin"
+	_ "github.com/osuripple/cheesegull/api/health"
 	_ "github.com/osuripple/cheesegull/api/metadata"
 )
 
@@ -36,6 +47,15 @@ var (
 	osuPassword = kingpin.Flag("osu-password", "osu! password (for downloading and fetching whether a beatmap has a video)").Short('p').Envar("OSU_PASSWORD").String()
 
 	beatconnectToken = kingpin.Flag("beatconnect-token", "beatconnect token. if provided, will use beatconnect rather than osu! website for downloading beatmaps").Envar("BEATCONNECT_TOKEN").String()
+	providers        = kingpin.Flag("providers", "Comma-separated list of the providers to download beatmaps from, tried in order (available: local, peer, osu, beatconnect). Defaults to beatconnect if a token is provided, otherwise osu.").Envar("PROVIDERS").String()
+
+	localDir      = kingpin.Flag("local-dir", "Directory tree containing existing .osz files, served by the local provider.").Envar("LOCAL_DIR").String()
+	localPatterns = kingpin.Flag("local-patterns", "Comma-separated list of patterns of the names of the sets in --local-dir. <id> is the set ID, * matches anything.").Default(strings.Join(downloader.DefaultLocalPatterns, ",")).Envar("LOCAL_PATTERNS").String()
+
+	peerURL    = kingpin.Flag("peer-url", "Base URL of another CheeseGull instance, used by the peer provider (e.g. https://cg.example.com).").Envar("PEER_URL").String()
+	peerAPIKey = kingpin.Flag("peer-api-key", "API key sent to the peer in the X-API-Key header, so that it is not rate limited or refused unranked sets like an anonymous client.").Envar("PEER_API_KEY").String()
+
+	verify = kingpin.Flag("verify", "Verify the contents of downloaded sets against the MD5s of their beatmaps. report only logs mismatches, reject discards the sets that don't match, so that they are downloaded again on the next request.").Default("report").Envar("VERIFY").Enum("off", "report", "reject")
 
 	allowUnranked = kingpin.Flag("allow-unranked", "Allow unranked beatmaps to be downloaded").Envar("ALLOW_UNRANKED").Default("false").Bool()
 
@@ -44,10 +64,69 @@ var (
 	httpAddr     = kingpin.Flag("http-addr", "Address on which to take HTTP requests.").Short('a').Default("127.0.0.1:62011").Envar("HTTP_ADDR").String()
 	maxDisk      = kingpin.Flag("max-disk", "Maximum number of GB used by beatmap cache.").Default("10").Envar("MAXIMUM_DISK").Float64()
 	removeNonZip = kingpin.Flag("remove-non-zip", "Remove non-zip files.").Default("false").Bool()
+	reconcile    = kingpin.Flag("reconcile", "Reconcile the state with the files in the storage, print the differences and exit. This is also done every time CheeseGull starts.").Default("false").Bool()
 	fckcfAddr    = kingpin.Flag("fckcf-addr", "fckcf http address").Envar("FCKCF_ADDR").String()
 	cgbinPath    = kingpin.Flag("cgbin-path", "cgbin.db file path").Default("cgbin.db").Envar("CGBIN_PATH").String()
+
+	storage     = kingpin.Flag("storage", "Where to keep the cached beatmaps: in a local directory, or in an S3-compatible object store.").Default("local").Envar("STORAGE").Enum("local", "s3")
+	dataDir     = kingpin.Flag("data-dir", "Directory of the beatmap cache, when using local storage.").Default("data").Envar("DATA_DIR").String()
+	s3Endpoint  = kingpin.Flag("s3-endpoint", "Base URL of the S3-compatible object store (e.g. https://s3.eu-central-1.amazonaws.com).").Envar("S3_ENDPOINT").String()
+	s3Bucket    = kingpin.Flag("s3-bucket", "Bucket of the object store in which to keep the beatmaps.").Envar("S3_BUCKET").String()
+	s3Region    = kingpin.Flag("s3-region", "Region of the object store.").Default("us-east-1").Envar("S3_REGION").String()
+	s3Prefix    = kingpin.Flag("s3-prefix", "Prefix of the keys of the beatmaps in the bucket (e.g. cheesegull/).").Envar("S3_PREFIX").String()
+	s3AccessKey = kingpin.Flag("s3-access-key", "Access key of the object store.").Envar("S3_ACCESS_KEY").String()
+	s3SecretKey = kingpin.Flag("s3-secret-key", "Secret key of the object store.").Envar("S3_SECRET_KEY").String()
+
+	quotas         = kingpin.Flag("quota", "Maximum number of GB used by the beatmaps with a ranked status, for instance graveyard=1. Can be repeated. Statuses are graveyard, wip, pending, ranked, approved, qualified and loved.").PlaceHolder("STATUS=GB").StringMap()
+	pins           = kingpin.Flag("pin", "Comma-separated list of the IDs of beatmap sets to never evict from the cache. Unlike the pins added through the admin API, they are not saved in the cgbin file.").Envar("PIN").String()
+	evictionPolicy = kingpin.Flag("eviction-policy", "Which beatmaps to remove first when the cache is full: lru (least recently requested), lfu (least frequently requested) or gdsf (least frequently requested, relative to their size).").Default("lru").Envar("EVICTION_POLICY").Enum("lru", "lfu", "gdsf")
 )
 
+var (
+	prefetchEnabled       = kingpin.Flag("prefetch", "Download in the background the sets which have just been ranked or loved, and the most popular ones, before anybody requests them.").Default("false").Envar("PREFETCH").Bool()
+	prefetchEvery         = kingpin.Flag("prefetch-every", "How often to look for new sets to prefetch.").Default("10m").Envar("PREFETCH_EVERY").Duration()
+	prefetchRankedWithin  = kingpin.Flag("prefetch-ranked-within", "Prefetch the sets ranked or loved within this time.").Default("72h").Envar("PREFETCH_RANKED_WITHIN").Duration()
+	prefetchMinFavourites = kingpin.Flag("prefetch-min-favourites", "Prefetch the sets with at least this many favourites.").Default("1000").Envar("PREFETCH_MIN_FAVOURITES").Int()
+	prefetchMinPlaycount  = kingpin.Flag("prefetch-min-playcount", "Prefetch the sets whose beatmaps have been played at least this many times in total.").Default("5000000").Envar("PREFETCH_MIN_PLAYCOUNT").Int()
+	prefetchLimit         = kingpin.Flag("prefetch-limit", "Maximum number of recently ranked sets, and of popular sets, to consider every time.").Default("200").Envar("PREFETCH_LIMIT").Int()
+	prefetchBandwidth     = kingpin.Flag("prefetch-bandwidth", "Maximum speed, in MB/s, at which to prefetch sets. 0 means unlimited.").Default("2").Envar("PREFETCH_BANDWIDTH").Float64()
+	prefetchDisk          = kingpin.Flag("prefetch-disk", "Maximum number of GB used by prefetched sets which have not been requested yet. Prefetching also never fills the cache over --max-disk.").Default("2").Envar("PREFETCH_DISK").Float64()
+)
+
+var (
+	maxDownloads      = kingpin.Flag("max-downloads", "Maximum number of sets downloaded from the providers at once. The others wait for their turn: requests for them are answered with 202 and their position in the X-Queue-Position header, which HEAD requests also return. 0 means unlimited.").Default("8").Envar("MAX_DOWNLOADS").Int()
+	providerDownloads = kingpin.Flag("provider-downloads", "Maximum number of sets downloaded from a provider at once, for instance osu=2. Can be repeated.").PlaceHolder("PROVIDER=N").StringMap()
+	downloadBandwidth = kingpin.Flag("download-bandwidth", "Maximum speed, in MB/s, at which to download sets from the providers, shared among all downloads. 0 means unlimited.").Default("0").Envar("DOWNLOAD_BANDWIDTH").Float64()
+)
+
+var (
+	trustedProxies = kingpin.Flag("trusted-proxies", "Comma-separated list of the IPs or networks (in CIDR notation) of the reverse proxies in front of CheeseGull, whose X-Forwarded-For header is trusted.").Envar("TRUSTED_PROXIES").String()
+	publicScopes   = kingpin.Flag("public-scopes", "Comma-separated list of what clients without an API key may do: download, download-unranked, search, admin. API keys are sent in the X-API-Key header or in the key query parameter, and are managed with the key command.").Default("download,search").Envar("PUBLIC_SCOPES").String()
+	searchRate     = kingpin.Flag("search-rate", "Maximum number of searches per minute of every client. 0 means unlimited.").Default("0").Envar("SEARCH_RATE").Int()
+	downloadQuota  = kingpin.Flag("download-quota", "Maximum number of GB every client may download per day. 0 means unlimited.").Default("0").Envar("DOWNLOAD_QUOTA").Float64()
+)
+
+var readyMaxStaleness = kingpin.Flag("ready-max-staleness", "Maximum time since a set in the database was last updated from the osu! API before /readyz reports CheeseGull as not ready. 0 disables the check.").Default("1h").Envar("READY_MAX_STALENESS").Duration()
+
+var shutdownTimeout = kingpin.Flag("shutdown-timeout", "How long to wait, when stopping, for the requests and the downloads to finish. The downloads still running afterwards are aborted.").Default("30s").Envar("SHUTDOWN_TIMEOUT").Duration()
+
+var (
+	logFormat = kingpin.Flag("log-format", "Format of the logs: text (key=value pairs) or json (one object per line).").Default("text").Envar("LOG_FORMAT").Enum("text", "json")
+	logLevel  = kingpin.Flag("log-level", "Minimum level of the messages to log: debug, info, warn or error.").Default("info").Envar("LOG_LEVEL").Enum("debug", "info", "warn", "error")
+)
+
+// newLogger creates the logger chosen with --log-format and --log-level.
+func newLogger() *slog.Logger {
+	var level slog.Level
+	// the flag is validated by kingpin, so this can't fail.
+	level.UnmarshalText([]byte(*logLevel))
+	opts := &slog.HandlerOptions{Level: level}
+	if *logFormat == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
 func addTimeParsing(dsn string) string {
 	sep := "?"
 	if strings.Contains(dsn, "?") {
@@ -57,20 +136,230 @@ func addTimeParsing(dsn string) string {
 	return dsn
 }
 
+// providerNames returns the names of the download providers to use, in order.
+func providerNames() []string {
+	if *providers == "" {
+		if *beatconnectToken != "" {
+			return []string{"beatconnect"}
+		}
+		return []string{"osu"}
+	}
+	return commaSeparated(*providers)
+}
+
+// commaSeparated splits a comma-separated list, ignoring empty elements.
+func commaSeparated(s string) []string {
+	var res []string
+	for _, el := range strings.Split(s, ",") {
+		el = strings.TrimSpace(el)
+		if el != "" {
+			res = append(res, el)
+		}
+	}
+	return res
+}
+
+// newProvider creates the downloader.Client for the provider with the given
+// name.
+func newProvider(logger *slog.Logger, name string) (downloader.Client, error) {
+	switch name {
+	case "local":
+		if *localDir == "" {
+			return nil, errors.New("the local provider requires --local-dir")
+		}
+		logger.Info("using local directory", "dir", *localDir)
+		return downloader.NewLocalClient(*localDir, commaSeparated(*localPatterns))
+	case "peer":
+		if *peerURL == "" {
+			return nil, errors.New("the peer provider requires --peer-url")
+		}
+		logger.Info("using peer", "url", *peerURL)
+		cl := downloader.NewPeerClient(*peerURL)
+		cl.APIKey = *peerAPIKey
+		return cl, nil
+	case "beatconnect":
+		if *beatconnectToken == "" {
+			return nil, errors.New("the beatconnect provider requires a beatconnect token")
+		}
+		logger.Info("using beatconnect")
+		return downloader.NewBeatConnectClient(*beatconnectToken), nil
+	case "osu":
+		logger.Info("using osu! website")
+
+		var reqPreparer downloader.LogInRequestPreparer
+		if *fckcfAddr == "" {
+			// No fckck address provided, disable it.
+			reqPreparer = &downloader.EmptyLogInRequestPreparer{}
+		} else {
+			// Fckcf address provided, use it as a proxy
+			reqPreparer = &downloader.FckCf{Address: *fckcfAddr}
+		}
+
+		cl, err := downloader.NewOsuClient(*osuUsername, *osuPassword, reqPreparer)
+		if err != nil {
+			return nil, fmt.Errorf("can't log in into osu!: %w", err)
+		}
+		return cl, nil
+	}
+	return nil, fmt.Errorf("unknown download provider %q", name)
+}
+
+// rankedStatuses are the names of the ranked statuses of beatmap sets.
+var rankedStatuses = map[string]int{
+	"graveyard": -2,
+	"wip":       -1,
+	"pending":   0,
+	"ranked":    1,
+	"approved":  2,
+	"qualified": 3,
+	"loved":     4,
+}
+
+// parseQuotas parses the quotas passed with --quota.
+func parseQuotas(m map[string]string) (map[int]uint64, error) {
+	res := make(map[int]uint64, len(m))
+	for name, gb := range m {
+		status, ok := rankedStatuses[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown ranked status %q", name)
+		}
+		n, err := strconv.ParseFloat(gb, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid quota for %s: %q", name, gb)
+		}
+		res[status] = uint64(float64(1024*1024*1024) * n)
+	}
+	return res, nil
+}
+
+// parseProviderDownloads parses the limits passed with --provider-downloads.
+func parseProviderDownloads(m map[string]string) (map[string]int, error) {
+	res := make(map[string]int, len(m))
+	for name, n := range m {
+		i, err := strconv.Atoi(n)
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("invalid number of downloads for %s: %q", name, n)
+		}
+		res[name] = i
+	}
+	return res, nil
+}
+
+// newStorage creates the housekeeper.Storage chosen with --storage.
+func newStorage(logger *slog.Logger) (housekeeper.Storage, error) {
+	if *storage != "s3" {
+		return housekeeper.LocalStorage(*dataDir), nil
+	}
+	if *s3Endpoint == "" || *s3Bucket == "" {
+		return nil, errors.New("s3 storage requires --s3-endpoint and --s3-bucket")
+	}
+	logger.Info("using S3 storage", "endpoint", *s3Endpoint, "bucket", *s3Bucket)
+	return &housekeeper.S3Storage{
+		Endpoint:  *s3Endpoint,
+		Bucket:    *s3Bucket,
+		Region:    *s3Region,
+		Prefix:    *s3Prefix,
+		AccessKey: *s3AccessKey,
+		SecretKey: *s3SecretKey,
+	}, nil
+}
+
+// registerMetrics registers the metrics about the cache and the download
+// queue, which are taken from them every time the metrics are written.
+func registerMetrics(house *housekeeper.House, queue *downloader.Queue) {
+	metrics.NewGaugeFunc("cheesegull_cache_size_bytes",
+		"Number of bytes used by the beatmaps in the cache.",
+		func() float64 { return float64(house.Size()) })
+	metrics.NewGaugeFunc("cheesegull_cache_max_size_bytes",
+		"Maximum number of bytes the beatmaps in the cache may use.",
+		func() float64 { return float64(house.MaxSize) })
+	metrics.NewGaugeFunc("cheesegull_download_queue_running",
+		"Number of sets being downloaded from the providers.",
+		func() float64 { return float64(queue.Status().Running) })
+	metrics.NewGaugeFunc("cheesegull_download_queue_waiting",
+		"Number of sets waiting for their turn to be downloaded from the providers.",
+		func() float64 { return float64(queue.Status().Waiting) })
+}
+
+var serveCmd = kingpin.Command("serve", "Run the CheeseGull server.").Default()
+
 func main() {
-	kingpin.Parse()
+	switch kingpin.Parse() {
+	case serveCmd.FullCommand():
+		serve()
+	case keyCreateCmd.FullCommand():
+		createKey()
+	case keyListCmd.FullCommand():
+		listKeys()
+	case keyRevokeCmd.FullCommand():
+		revokeKey()
+	}
+}
+
+// fatal logs an error which prevents CheeseGull from running, and exits.
+func fatal(logger *slog.Logger, msg string, err error, args ...any) {
+	logger.Error(msg, append(args, "err", err)...)
+	os.Exit(1)
+}
+
+func serve() {
+	// set up logging. The default logger is replaced as well, so that what
+	// is logged with the log package ends up in the same place.
+	logger := newLogger()
+	slog.SetDefault(logger)
+	dbmirror.Logger = logger
 
-	fmt.Println("CheeseGull", Version)
+	logger.Info("starting CheeseGull", "version", Version)
 	api.Version = Version
 
 	// set up housekeeper
 	house := housekeeper.New(*cgbinPath)
-	err := house.LoadState()
+	house.Logger = logger
+	var err error
+	house.Storage, err = newStorage(logger)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		fatal(logger, "can't set up the storage", err)
+	}
+	err = house.LoadState()
+	var corruptErr *housekeeper.CorruptStateError
+	switch {
+	case errors.As(err, &corruptErr):
+		// the beatmaps in the corrupt records are simply forgotten.
+		logger.Warn("the state file is partly corrupt", "err", err)
+	case err != nil:
+		fatal(logger, "can't load the state", err)
 	}
 	house.MaxSize = uint64(float64(1024*1024*1024) * (*maxDisk))
+	house.Policy, err = housekeeper.NewPolicy(*evictionPolicy)
+	if err != nil {
+		fatal(logger, "invalid --eviction-policy", err)
+	}
+	house.Quotas, err = parseQuotas(*quotas)
+	if err != nil {
+		fatal(logger, "invalid --quota", err)
+	}
+	house.StaticPins = make(map[int]bool)
+	for _, s := range commaSeparated(*pins) {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			fatal(logger, "invalid --pin", err, "set_id", s)
+		}
+		house.StaticPins[id] = true
+	}
+	report, err := house.Reconcile()
+	if err != nil {
+		logger.Error("can't reconcile state with storage", "err", err)
+	}
+	if *reconcile {
+		logger.Info("reconciled files",
+			"adopted", report.Adopted,
+			"dropped", report.Dropped,
+			"resized", report.Resized,
+			"broken", report.Broken,
+			"ignored", report.Ignored,
+		)
+		return
+	}
 	if *removeNonZip {
 		house.RemoveNonZip()
 		return
@@ -81,57 +370,184 @@ func main() {
 	c := osuapi.NewClient(*osuAPIKey)
 
 	// set up downloader
-	var downloaderClient downloader.Client
-	if *beatconnectToken != "" {
-		fmt.Println("Using beatconnect")
-		downloaderClient = downloader.NewBeatConnectClient(*beatconnectToken)
-	} else {
-		fmt.Println("Using osu! website")
-
-		var reqPreparer downloader.LogInRequestPreparer
-		if *fckcfAddr == "" {
-			// No fckck address provided, disable it.
-			reqPreparer = &downloader.EmptyLogInRequestPreparer{}
-		} else {
-			// Fckcf address provided, use it as a proxy
-			reqPreparer = &downloader.FckCf{Address: *fckcfAddr}
-		}
-
-		downloaderClient, err = downloader.NewOsuClient(*osuUsername, *osuPassword, reqPreparer)
+	concurrency, err := parseProviderDownloads(*providerDownloads)
+	if err != nil {
+		fatal(logger, "invalid --provider-downloads", err)
+	}
+	var chain []downloader.Provider
+	for _, name := range providerNames() {
+		cl, err := newProvider(logger, name)
 		if err != nil {
-			fmt.Println("Can't log in into osu!:", err)
-			os.Exit(1)
+			fatal(logger, "can't set up provider", err, "provider", name)
+		}
+		chain = append(chain, downloader.Provider{Name: name, Client: cl})
+	}
+	ch := downloader.NewChain(chain...)
+	ch.Logger = logger
+	for name, n := range concurrency {
+		q := ch.Queue(name)
+		if q == nil {
+			fatal(logger, "invalid --provider-downloads", errors.New("unknown provider"), "provider", name)
 		}
+		q.SetLimit(n)
 	}
+	d := downloader.NewDownloader(ch)
+	d.Logger = logger
+	d.Rate = downloader.NewRateLimiter(int64(float64(1024*1024) * (*downloadBandwidth)))
+	queue := downloader.NewQueue(*maxDownloads)
+
+	registerMetrics(house, queue)
 
-	d := downloader.NewDownloader(downloaderClient)
+	verifyMode, err := downloader.ParseVerifyMode(*verify)
+	if err != nil {
+		fatal(logger, "invalid --verify", err)
+	}
 
 	// set up mysql
 	db, err := sql.Open("mysql", addTimeParsing(*mysqlDSN))
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		fatal(logger, "can't open MySQL", err)
 	}
 
 	// set up search
 	db2, err := sql.Open("mysql", *searchDSN)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		fatal(logger, "can't open the search database", err)
 	}
 
 	// run mysql migrations
 	err = models.RunMigrations(db)
 	if err != nil {
-		fmt.Println("Error running migrations", err)
+		logger.Error("can't run migrations", "err", err)
 	}
 
+	// ctx is done when we are asked to stop. Stopping it restores the default
+	// behaviour of the signals, so that a second one kills CheeseGull right
+	// away if it takes too long to stop.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// start running components of cheesegull
-	go dbmirror.StartSetUpdater(c, db)
-	go dbmirror.DiscoverEvery(c, db, time.Hour*6, time.Second*20)
+	var workers sync.WaitGroup
+	run := func(f func()) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			f()
+		}()
+	}
+	run(func() { dbmirror.StartSetUpdater(ctx, c, db) })
+	run(func() { dbmirror.DiscoverEvery(ctx, c, db, time.Hour*6, time.Second*20) })
+	if *prefetchEnabled {
+		p := &prefetch.Prefetcher{
+			Source: &prefetch.DBSource{
+				DB:            db,
+				RankedWithin:  *prefetchRankedWithin,
+				MinFavourites: *prefetchMinFavourites,
+				MinPlaycount:  *prefetchMinPlaycount,
+				Limit:         *prefetchLimit,
+			},
+			House:      house,
+			Client:     d,
+			Queue:      queue,
+			Rate:       downloader.NewRateLimiter(int64(float64(1024*1024) * (*prefetchBandwidth))),
+			DiskBudget: uint64(float64(1024*1024*1024) * (*prefetchDisk)),
+			Logger:     logger,
+		}
+		if verifyMode != downloader.VerifyOff {
+			p.Verify = func(ctx context.Context, b *housekeeper.CachedBeatmap) error {
+				return download.VerifyBeatmap(ctx, db, verifyMode, logger, b)
+			}
+		}
+		run(func() { p.Run(ctx, *prefetchEvery) })
+	}
+
+	for _, s := range commaSeparated(*publicScopes) {
+		if !models.ValidScope(s) {
+			fatal(logger, "invalid --public-scopes", errors.New("unknown scope"), "scope", s)
+		}
+	}
+	proxies, err := api.ParseTrustedProxies(commaSeparated(*trustedProxies))
+	if err != nil {
+		fatal(logger, "invalid --trusted-proxies", err)
+	}
+	var middlewares []api.Middleware
+	if *searchRate > 0 || *downloadQuota > 0 {
+		limit := &api.RateLimit{
+			SearchesPerMinute:   *searchRate,
+			DownloadBytesPerDay: int64(float64(1024*1024*1024) * (*downloadQuota)),
+		}
+		middlewares = append(middlewares, limit.Middleware)
+	}
+
+	// the downloads started by the requests are given some time to finish
+	// after we are asked to stop, so they have their own context.
+	background, abortBackground := context.WithCancel(context.Background())
+	defer abortBackground()
 
 	// create request handler
-	panic(http.ListenAndServe(*httpAddr, api.CreateHandler(db, db2, house, d, api.Options{
-		AllowUnranked: *allowUnranked,
-	})))
+	srv := &http.Server{
+		Addr: *httpAddr,
+		Handler: api.CreateHandler(db, db2, house, d, api.Options{
+			AllowUnranked:     *allowUnranked,
+			Verify:            verifyMode,
+			Queue:             queue,
+			Middlewares:       middlewares,
+			TrustedProxies:    proxies,
+			PublicScopes:      commaSeparated(*publicScopes),
+			OsuAPI:            c,
+			Logger:            logger,
+			Background:        background,
+			ReadyMaxStaleness: *readyMaxStaleness,
+		}),
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errc:
+		fatal(logger, "can't serve HTTP", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	shutdown(logger, srv, house, abortBackground)
+	workers.Wait()
+	// the discoveries started through the admin API stop once the
+	// background context is aborted by shutdown.
+	dbmirror.WaitDiscoveries()
+	if err := house.SaveState(); err != nil {
+		logger.Error("can't save state", "err", err)
+		os.Exit(1)
+	}
+	logger.Info("stopped")
+}
+
+// shutdown stops the HTTP server, waiting for the requests being handled and
+// the downloads they started to finish. The ones which don't finish within
+// --shutdown-timeout are aborted, and the downloads are waited for again so
+// that no partially downloaded beatmap is left behind.
+func shutdown(logger *slog.Logger, srv *http.Server, house *housekeeper.House, abortBackground context.CancelFunc) {
+	logger.Info("stopping", "timeout", *shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
+	if err == nil {
+		err = house.WaitDownloads(ctx)
+	}
+	abortBackground()
+	if err == nil {
+		return
+	}
+
+	logger.Warn("aborting the requests and the downloads still running",
+		"downloads", house.Downloading())
+	srv.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err := house.WaitDownloads(ctx); err != nil {
+		logger.Error("some downloads could not be aborted", "downloads", house.Downloading())
+	}
 }
@@ -3,9 +3,11 @@
 package dbmirror
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"log/slog"
 	"os"
+	"sync"
 	"time"
 
 	raven "github.com/getsentry/raven-go"
@@ -106,60 +108,192 @@ func updateSet(c *osuapi.Client, db *sql.DB, set models.Set) error {
 	return models.CreateSet(db, set)
 }
 
-// By making the buffer the same size of the batch, we can be sure that all
-// sets from the previous batch will have completed by the time we finish
-// pushing all the beatmaps to the queue.
-var setQueue = make(chan models.Set, PerBatch)
+// UpdateSet brings the information in the database up-to-date for the set
+// with the given ID right away, without waiting for the set updater to get to
+// it. If the set is not in the database yet, it is added.
+func UpdateSet(c *osuapi.Client, db *sql.DB, id int) error {
+	set, err := models.FetchSet(db, id, false)
+	if err != nil {
+		return err
+	}
+	if set == nil {
+		set = &models.Set{ID: id}
+	}
+	return updateSet(c, db, *set)
+}
 
 // setUpdater is a function to be run as a goroutine, that receives sets
-// from setQueue and brings the information in the database up-to-date for that
-// set.
-func setUpdater(c *osuapi.Client, db *sql.DB) {
-	for set := range setQueue {
+// from queue and brings the information in the database up-to-date for that
+// set. Once ctx is done, the sets left in the queue are skipped.
+func setUpdater(ctx context.Context, c *osuapi.Client, db *sql.DB, queue <-chan models.Set) {
+	for set := range queue {
+		if ctx.Err() != nil {
+			// they will be updated the next time the set updater runs.
+			updater.dropped(set.ID)
+			continue
+		}
+		updater.started(set.ID)
 		err := updateSet(c, db, set)
+		updater.finished(set.ID)
 		if err != nil {
-			logError(err)
+			setsUpdated.Inc("failed")
+			logError("can't update set", err, "set_id", set.ID)
+			continue
+		}
+		setsUpdated.Inc("ok")
+	}
+}
+
+// UpdaterStatus is the state of the set updater.
+type UpdaterStatus struct {
+	Workers int
+	// Queued are the IDs of the sets waiting to be updated, in order.
+	Queued []int
+	// Updating are the IDs of the sets being updated.
+	Updating  []int
+	LastBatch time.Time
+}
+
+type updaterState struct {
+	mtx    sync.Mutex
+	status UpdaterStatus
+}
+
+var updater = &updaterState{status: UpdaterStatus{Workers: SetUpdaterWorkers}}
+
+func (u *updaterState) queued(id int) {
+	u.mtx.Lock()
+	u.status.Queued = append(u.status.Queued, id)
+	u.mtx.Unlock()
+}
+
+func (u *updaterState) dropped(id int) {
+	u.mtx.Lock()
+	u.status.Queued = withoutID(u.status.Queued, id)
+	u.mtx.Unlock()
+}
+
+func (u *updaterState) started(id int) {
+	u.mtx.Lock()
+	u.status.Queued = withoutID(u.status.Queued, id)
+	u.status.Updating = append(u.status.Updating, id)
+	u.mtx.Unlock()
+}
+
+func (u *updaterState) finished(id int) {
+	u.mtx.Lock()
+	u.status.Updating = withoutID(u.status.Updating, id)
+	u.mtx.Unlock()
+}
+
+// withoutID removes the first occurrence of id from ids.
+func withoutID(ids []int, id int) []int {
+	for i, el := range ids {
+		if el == id {
+			return append(ids[:i], ids[i+1:]...)
 		}
 	}
+	return ids
+}
+
+// Updater returns the current state of the set updater.
+func Updater() UpdaterStatus {
+	updater.mtx.Lock()
+	defer updater.mtx.Unlock()
+	s := updater.status
+	s.Queued = append([]int{}, s.Queued...)
+	s.Updating = append([]int{}, s.Updating...)
+	return s
 }
 
 // StartSetUpdater does batch updates for the beatmaps in the database,
 // employing goroutines to fetch the data from the osu! API and then write it to
-// the database.
-func StartSetUpdater(c *osuapi.Client, db *sql.DB) {
+// the database. It runs until ctx is done, and then returns once the sets
+// which were being updated are done.
+func StartSetUpdater(ctx context.Context, c *osuapi.Client, db *sql.DB) {
+	// By making the buffer the same size of the batch, we can be sure that
+	// all sets from the previous batch will have completed by the time we
+	// finish pushing all the beatmaps to the queue.
+	queue := make(chan models.Set, PerBatch)
+	var wg sync.WaitGroup
 	for i := 0; i < SetUpdaterWorkers; i++ {
-		go setUpdater(c, db)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			setUpdater(ctx, c, db, queue)
+		}()
 	}
+	defer func() {
+		close(queue)
+		wg.Wait()
+	}()
+
 	for {
 		sets, err := models.FetchSetsForBatchUpdate(db, PerBatch)
 		if err != nil {
-			logError(err)
-			time.Sleep(NewBatchEvery)
+			logError("can't fetch sets to update", err)
+			if !sleep(ctx, NewBatchEvery) {
+				return
+			}
 			continue
 		}
+		updater.mtx.Lock()
+		updater.status.LastBatch = time.Now()
+		updater.mtx.Unlock()
 		for _, set := range sets {
-			setQueue <- set
+			updater.queued(set.ID)
+			select {
+			case queue <- set:
+			case <-ctx.Done():
+				updater.dropped(set.ID)
+				return
+			}
 		}
 		if len(sets) > 0 {
-			log.Printf("[U] Updating sets, oldest LastChecked %v, newest %v, total length %d",
-				sets[0].LastChecked,
-				sets[len(sets)-1].LastChecked,
-				len(sets),
+			logger().Info("updating sets",
+				"oldest_last_checked", sets[0].LastChecked,
+				"newest_last_checked", sets[len(sets)-1].LastChecked,
+				"count", len(sets),
 			)
 		}
-		time.Sleep(NewBatchEvery)
+		if !sleep(ctx, NewBatchEvery) {
+			return
+		}
+	}
+}
+
+// sleep waits for d to elapse, and returns false if ctx is done before.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Logger is used to log what the set updater and the discovery do. If nil,
+// slog.Default() is used.
+var Logger *slog.Logger
+
+func logger() *slog.Logger {
+	if Logger != nil {
+		return Logger
 	}
+	return slog.Default()
 }
 
 var envSentryDSN = os.Getenv("SENTRY_DSN")
 
-// logError attempts to log an error to Sentry, as well as stdout.
-func logError(err error) {
+// logError attempts to log an error to Sentry, as well as to the Logger.
+func logError(msg string, err error, args ...any) {
 	if err == nil {
 		return
 	}
 	if envSentryDSN != "" {
 		raven.CaptureError(err, nil)
 	}
-	log.Println(err)
+	logger().Error(msg, append(args, "err", err)...)
 }
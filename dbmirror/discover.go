@@ -1,30 +1,128 @@
 package dbmirror
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/osuripple/cheesegull/models"
 	osuapi "github.com/thehowl/go-osuapi"
 )
 
-// Discover discovers new beatmaps in the osu! database and adds them.
-func Discover(c *osuapi.Client, db *sql.DB) error {
+// ErrDiscoveryRunning is returned by Discover when a discovery is already
+// running.
+var ErrDiscoveryRunning = errors.New("cheesegull/dbmirror: discovery is already running")
+
+// DiscoveryStatus is the state of the discovery of new beatmaps.
+type DiscoveryStatus struct {
+	Running bool
+	// StartID is the biggest set ID in the database when the discovery
+	// started, and CurrentID the ID of the set being looked up.
+	StartID    int
+	CurrentID  int
+	Found      int
+	StartedAt  time.Time
+	FinishedAt time.Time `json:",omitempty"`
+	Error      string    `json:",omitempty"`
+}
+
+var discovery struct {
+	mtx    sync.Mutex
+	status DiscoveryStatus
+	// background are the discoveries started by DiscoverInBackground.
+	background sync.WaitGroup
+}
+
+// Discovery returns the state of the current discovery, or of the last one if
+// none is running.
+func Discovery() DiscoveryStatus {
+	discovery.mtx.Lock()
+	defer discovery.mtx.Unlock()
+	return discovery.status
+}
+
+// startDiscovery marks a discovery as running, and returns false if one
+// already was.
+func startDiscovery() bool {
+	discovery.mtx.Lock()
+	defer discovery.mtx.Unlock()
+	if discovery.status.Running {
+		return false
+	}
+	discovery.status = DiscoveryStatus{Running: true, StartedAt: time.Now()}
+	return true
+}
+
+// Discover discovers new beatmaps in the osu! database and adds them, until
+// there are no more or ctx is done. Only one discovery can run at a time: if
+// another one is running, ErrDiscoveryRunning is returned.
+func Discover(ctx context.Context, c *osuapi.Client, db *sql.DB) error {
+	if !startDiscovery() {
+		return ErrDiscoveryRunning
+	}
+	return discover(ctx, c, db)
+}
+
+// DiscoverInBackground starts a discovery in a new goroutine, unless one is
+// already running, in which case it returns false. The discovery stops when
+// ctx is done, and WaitDiscoveries waits for it to be over.
+func DiscoverInBackground(ctx context.Context, c *osuapi.Client, db *sql.DB) bool {
+	if !startDiscovery() {
+		return false
+	}
+	discovery.background.Add(1)
+	go func() {
+		defer discovery.background.Done()
+		err := discover(ctx, c, db)
+		if ctx.Err() == nil {
+			logError("discovery failed", err)
+		}
+	}()
+	return true
+}
+
+// WaitDiscoveries waits for the discoveries started by DiscoverInBackground to
+// be over, so that none is writing to the database when CheeseGull exits.
+func WaitDiscoveries() {
+	discovery.background.Wait()
+}
+
+func discover(ctx context.Context, c *osuapi.Client, db *sql.DB) (err error) {
+	defer func() {
+		discovery.mtx.Lock()
+		discovery.status.Running = false
+		discovery.status.FinishedAt = time.Now()
+		if err != nil {
+			discovery.status.Error = err.Error()
+		}
+		discovery.mtx.Unlock()
+	}()
+
 	id, err := models.BiggestSetID(db)
 	if err != nil {
 		return err
 	}
-	log.Println("[D] Starting discovery with ID", id)
+	logger().Info("starting discovery", "set_id", id)
+	discovery.mtx.Lock()
+	discovery.status.StartID = id
+	discovery.mtx.Unlock()
 	// failedAttempts is the number of consecutive failed attempts at fetching a
 	// beatmap (by 'failed', in this case we mean exclusively when a request to
 	// get_beatmaps returns no beatmaps)
 	failedAttempts := 0
 	for failedAttempts < 4096 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		id++
 		if id%64 == 0 {
-			log.Println("[D]", id)
+			logger().Debug("discovery progress", "set_id", id)
 		}
+		discovery.mtx.Lock()
+		discovery.status.CurrentID = id
+		discovery.mtx.Unlock()
 		var (
 			err error
 			bms []osuapi.Beatmap
@@ -57,6 +155,9 @@ func Discover(c *osuapi.Client, db *sql.DB) error {
 		if err != nil {
 			return err
 		}
+		discovery.mtx.Lock()
+		discovery.status.Found++
+		discovery.mtx.Unlock()
 	}
 
 	return nil
@@ -65,15 +166,23 @@ func Discover(c *osuapi.Client, db *sql.DB) error {
 // DiscoverEvery runs Discover and waits for it to finish. If Discover returns
 // an error, then it will wait errorWait before running Discover again. If
 // Discover doesn't return any error, then it will wait successWait before
-// running Discover again.
-func DiscoverEvery(c *osuapi.Client, db *sql.DB, successWait, errorWait time.Duration) {
+// running Discover again. It returns once ctx is done.
+func DiscoverEvery(ctx context.Context, c *osuapi.Client, db *sql.DB, successWait, errorWait time.Duration) {
 	for {
-		err := Discover(c, db)
-		if err == nil {
-			time.Sleep(successWait)
-		} else {
-			logError(err)
-			time.Sleep(errorWait)
+		err := Discover(ctx, c, db)
+		wait := errorWait
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err == nil:
+			wait = successWait
+		case err == ErrDiscoveryRunning:
+			// somebody else started a discovery: try again after it.
+		default:
+			logError("discovery failed", err)
+		}
+		if !sleep(ctx, wait) {
+			return
 		}
 	}
 }
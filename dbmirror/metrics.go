@@ -0,0 +1,46 @@
+package dbmirror
+
+import (
+	"github.com/osuripple/cheesegull/metrics"
+)
+
+var setsUpdated = metrics.NewCounter("cheesegull_updater_updated_sets_total",
+	"Number of sets updated by the set updater, by result: ok or failed.", "result")
+
+func b2f(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func init() {
+	metrics.NewGaugeFunc("cheesegull_updater_queued_sets",
+		"Number of sets waiting to be updated by the set updater.",
+		func() float64 { return float64(len(Updater().Queued)) })
+	metrics.NewGaugeFunc("cheesegull_updater_updating_sets",
+		"Number of sets being updated by the set updater.",
+		func() float64 { return float64(len(Updater().Updating)) })
+	metrics.NewGaugeFunc("cheesegull_updater_last_batch_timestamp_seconds",
+		"Time at which the set updater last fetched a batch of sets to update, as a Unix timestamp.",
+		func() float64 {
+			t := Updater().LastBatch
+			if t.IsZero() {
+				return 0
+			}
+			return float64(t.UnixNano()) / 1e9
+		})
+
+	metrics.NewGaugeFunc("cheesegull_discovery_running",
+		"Whether a discovery of new sets is running.",
+		func() float64 { return b2f(Discovery().Running) })
+	metrics.NewGaugeFunc("cheesegull_discovery_start_id",
+		"Biggest set ID in the database when the current or last discovery started.",
+		func() float64 { return float64(Discovery().StartID) })
+	metrics.NewGaugeFunc("cheesegull_discovery_current_id",
+		"ID of the set being looked up by the current discovery, or the last one looked up by the last discovery.",
+		func() float64 { return float64(Discovery().CurrentID) })
+	metrics.NewGaugeFunc("cheesegull_discovery_found_sets",
+		"Number of new sets found by the current or last discovery.",
+		func() float64 { return float64(Discovery().Found) })
+}
@@ -1,10 +1,10 @@
 package downloader
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
-	"time"
 )
 
 const BeatConnectAPIBase = "https://beatconnect.io"
@@ -17,19 +17,18 @@ type BeatConnectClient struct {
 
 // NewBeatConnectClient returns a new BeatConnectClient.
 func NewBeatConnectClient(apiToken string) *BeatConnectClient {
-	cl := http.DefaultClient
-	// I really wish we had context.Context back in the day.
-	cl.Timeout = time.Minute * 2
 	return &BeatConnectClient{
-		httpClient: cl,
+		// timeouts are given by the context passed to Download.
+		httpClient: &http.Client{},
 		apiToken:   apiToken,
 	}
 }
 
 // newRequest creates a new http.Request with the given relativeURL.
 // If withToken is true, it adds the 'token' query parameter to the request.
-func (c *BeatConnectClient) newRequest(relativeURL string, withToken bool) (*http.Request, error) {
-	req, err := http.NewRequest(
+func (c *BeatConnectClient) newRequest(ctx context.Context, relativeURL string, withToken bool) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
 		http.MethodGet,
 		BeatConnectAPIBase+"/"+relativeURL,
 		nil,
@@ -71,8 +70,8 @@ func (c *BeatConnectClient) newRequest(relativeURL string, withToken bool) (*htt
 
 // Download downloads the osz file from BeatConnect.
 // The noVideo flag is ignored, the video is always included.
-func (c *BeatConnectClient) Download(setID int, noVideo bool) (io.ReadCloser, error) {
-	oszReq, err := c.newRequest(fmt.Sprintf("b/%d", setID), false)
+func (c *BeatConnectClient) Download(ctx context.Context, setID int, noVideo bool) (io.ReadCloser, error) {
+	oszReq, err := c.newRequest(ctx, fmt.Sprintf("b/%d", setID), false)
 	if err != nil {
 		return nil, fmt.Errorf("new request: %w", err)
 	}
@@ -0,0 +1,261 @@
+package downloader
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is the state in which a Breaker is.
+type BreakerState int
+
+// These are the states in which a Breaker can be.
+const (
+	// BreakerClosed is the normal state: all calls go through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen means the provider is sick: no calls go through.
+	BreakerOpen
+	// BreakerHalfOpen means the breaker has been open for long enough, and
+	// a few trial calls are let through to see whether the provider has
+	// recovered.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// MarshalText implements encoding.TextMarshaler, so that states are shown
+// by name in the API.
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Default values for the settings of a Breaker.
+const (
+	DefaultBreakerWindow        = 20
+	DefaultBreakerMinCalls      = 5
+	DefaultBreakerFailureRate   = 0.5
+	DefaultBreakerSlowCall      = time.Second * 30
+	DefaultBreakerOpenFor       = time.Second * 30
+	DefaultBreakerHalfOpenCalls = 1
+)
+
+type callResult struct {
+	failed  bool
+	latency time.Duration
+}
+
+// Breaker is a circuit breaker for a download provider. It keeps track of
+// the outcome and latency of the most recent calls to the provider, and when
+// too many of them fail (or are too slow), it opens, making calls to the
+// provider fail fast until OpenFor has elapsed. At that point, it lets
+// HalfOpenCalls calls through: if they all succeed, the breaker is closed
+// again, otherwise it goes back to being open.
+type Breaker struct {
+	// Window is the number of most recent calls used to calculate the error
+	// rate.
+	Window int
+	// MinCalls is the minimum number of calls in the window before the
+	// breaker can be opened.
+	MinCalls int
+	// FailureRate is the rate of failed calls in the window (0-1) at which
+	// the breaker is opened.
+	FailureRate float64
+	// SlowCall is the latency over which a call is considered a failure,
+	// even if it did not return an error.
+	SlowCall time.Duration
+	// OpenFor is the amount of time for which the breaker stays open before
+	// trying new calls.
+	OpenFor time.Duration
+	// HalfOpenCalls is the number of calls that must succeed while
+	// half-open for the breaker to be closed again.
+	HalfOpenCalls int
+
+	mtx      sync.Mutex
+	state    BreakerState
+	openedAt time.Time
+	results  []callResult
+	next     int
+	// in the half-open state, the number of calls let through and the
+	// number of those which succeeded.
+	trials    int
+	successes int
+
+	calls, failures uint64
+}
+
+// NewBreaker creates a new Breaker using the default settings.
+func NewBreaker() *Breaker {
+	return &Breaker{
+		Window:        DefaultBreakerWindow,
+		MinCalls:      DefaultBreakerMinCalls,
+		FailureRate:   DefaultBreakerFailureRate,
+		SlowCall:      DefaultBreakerSlowCall,
+		OpenFor:       DefaultBreakerOpenFor,
+		HalfOpenCalls: DefaultBreakerHalfOpenCalls,
+	}
+}
+
+// Allow checks whether a call may be made. Every call for which Allow
+// returned true must be followed by a call to Record.
+func (b *Breaker) Allow() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.OpenFor {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.trials, b.successes = 0, 0
+		fallthrough
+	case BreakerHalfOpen:
+		if b.trials >= b.HalfOpenCalls {
+			return false
+		}
+		b.trials++
+	}
+	return true
+}
+
+// Discard must be called instead of Record when the outcome of a call can't
+// be attributed to the provider, for instance because the call was cancelled.
+func (b *Breaker) Discard() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.state == BreakerHalfOpen && b.trials > 0 {
+		b.trials--
+	}
+}
+
+// ready is like Allow, but it doesn't change the state of the breaker.
+func (b *Breaker) ready() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return time.Since(b.openedAt) >= b.OpenFor
+	case BreakerHalfOpen:
+		return b.trials < b.HalfOpenCalls
+	}
+	return true
+}
+
+// Record records the outcome of a call.
+func (b *Breaker) Record(err error, latency time.Duration) {
+	failed := err != nil || (b.SlowCall > 0 && latency > b.SlowCall)
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.calls++
+	if failed {
+		b.failures++
+	}
+
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed {
+			b.open()
+			return
+		}
+		b.successes++
+		if b.successes >= b.HalfOpenCalls {
+			b.state = BreakerClosed
+			b.resetWindow()
+		}
+		// keep track of the latency of the calls done while half-open.
+		b.push(callResult{latency: latency})
+	case BreakerClosed:
+		b.push(callResult{failed: failed, latency: latency})
+		n, failedN, _ := b.window()
+		if n >= b.MinCalls && float64(failedN)/float64(n) >= b.FailureRate {
+			b.open()
+		}
+	case BreakerOpen:
+		// a call that started before the breaker was opened; its result
+		// doesn't change anything.
+	}
+}
+
+// open must be called with b.mtx held.
+func (b *Breaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+	b.resetWindow()
+}
+
+func (b *Breaker) resetWindow() {
+	b.results = b.results[:0]
+	b.next = 0
+}
+
+func (b *Breaker) push(r callResult) {
+	if b.Window <= 0 {
+		return
+	}
+	if len(b.results) < b.Window {
+		b.results = append(b.results, r)
+		return
+	}
+	b.results[b.next] = r
+	b.next = (b.next + 1) % b.Window
+}
+
+// window returns the number of calls in the window, how many of them failed
+// and their average latency.
+func (b *Breaker) window() (n, failed int, avgLatency time.Duration) {
+	var total time.Duration
+	for _, r := range b.results {
+		if r.failed {
+			failed++
+		}
+		total += r.latency
+	}
+	n = len(b.results)
+	if n > 0 {
+		avgLatency = total / time.Duration(n)
+	}
+	return
+}
+
+// BreakerStatus is a snapshot of the state of a Breaker.
+type BreakerStatus struct {
+	State BreakerState
+	// ErrorRate and AvgLatencyMS are calculated on the calls in the window.
+	ErrorRate    float64
+	AvgLatencyMS float64
+	// Calls and Failures are the totals since the breaker was created.
+	Calls    uint64
+	Failures uint64
+	// OpenUntil is set when the breaker is open.
+	OpenUntil *time.Time `json:",omitempty"`
+}
+
+// Status returns the current status of the breaker.
+func (b *Breaker) Status() BreakerStatus {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	n, failed, avg := b.window()
+	s := BreakerStatus{
+		State:        b.state,
+		AvgLatencyMS: float64(avg) / float64(time.Millisecond),
+		Calls:        b.calls,
+		Failures:     b.failures,
+	}
+	if n > 0 {
+		s.ErrorRate = float64(failed) / float64(n)
+	}
+	if b.state == BreakerOpen {
+		t := b.openedAt.Add(b.OpenFor)
+		s.OpenUntil = &t
+	}
+	return s
+}
@@ -0,0 +1,73 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreaker(t *testing.T) {
+	b := NewBreaker()
+	b.OpenFor = time.Millisecond * 50
+	errFailed := errors.New("failed")
+
+	// a few successes and failures: not enough to open the breaker
+	for i := 0; i < 3; i++ {
+		require.True(t, b.Allow())
+		b.Record(nil, time.Millisecond)
+	}
+	for i := 0; i < 2; i++ {
+		require.True(t, b.Allow())
+		b.Record(errFailed, time.Millisecond)
+	}
+	require.Equal(t, BreakerClosed, b.Status().State)
+
+	// slow calls count as failures
+	require.True(t, b.Allow())
+	b.Record(nil, b.SlowCall+time.Second)
+	require.Equal(t, BreakerOpen, b.Status().State)
+	require.False(t, b.Allow())
+	require.NotNil(t, b.Status().OpenUntil)
+
+	// after OpenFor, a single trial call is allowed
+	time.Sleep(b.OpenFor)
+	require.True(t, b.Allow())
+	require.False(t, b.Allow())
+	require.Equal(t, BreakerHalfOpen, b.Status().State)
+
+	// the trial fails: back to open
+	b.Record(errFailed, time.Millisecond)
+	require.Equal(t, BreakerOpen, b.Status().State)
+	require.False(t, b.Allow())
+
+	// the trial succeeds: closed again
+	time.Sleep(b.OpenFor)
+	require.True(t, b.Allow())
+	b.Record(nil, time.Millisecond)
+	require.Equal(t, BreakerClosed, b.Status().State)
+	require.True(t, b.Allow())
+	b.Record(nil, time.Millisecond)
+
+	s := b.Status()
+	require.EqualValues(t, 9, s.Calls)
+	require.EqualValues(t, 4, s.Failures)
+}
+
+func TestDownloaderFailsFast(t *testing.T) {
+	down := &fakeClient{err: ErrTemporaryFailure}
+	c := NewChain(Provider{"down", down})
+	c.Breaker("down").MinCalls = 2
+	d := NewDownloader(c)
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		_, err := d.Download(context.Background(), 1, false)
+		require.ErrorIs(t, err, ErrNoProvider)
+	}
+	// the downloader must not wait for all the retries.
+	require.Less(t, time.Since(start), time.Second*2)
+	require.Equal(t, 2, down.calls)
+}
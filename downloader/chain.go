@@ -0,0 +1,243 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/osuripple/cheesegull/metrics"
+)
+
+var (
+	providerDownloads = metrics.NewCounter("cheesegull_provider_downloads_total",
+		"Number of downloads started from the providers, by provider and result: ok, failed, or unavailable if the provider does not have the set.", "provider", "result")
+	providerLatency = metrics.NewHistogram("cheesegull_provider_download_latency_seconds",
+		"Time taken by the providers to start sending a set, or to fail, by provider.",
+		[]float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}, "provider")
+)
+
+// ErrNoProvider is returned from Chain's Download when the circuit breakers
+// of all of the providers in the chain are open, and thus none of them could
+// be tried.
+var ErrNoProvider = errors.New("cheesegull/downloader: no healthy provider available")
+
+// maxServedBy is the number of sets for which a Chain remembers the provider
+// which served them.
+const maxServedBy = 10000
+
+// Provider is a Client with a name, to be used in a Chain.
+type Provider struct {
+	Name   string
+	Client Client
+}
+
+type chainProvider struct {
+	Provider
+	breaker *Breaker
+	queue   *Queue
+}
+
+// ProviderStatus is the status of a provider in a Chain.
+type ProviderStatus struct {
+	Name string
+	BreakerStatus
+	Queue QueueStatus
+}
+
+// Chain is a Client which tries to download beatmap sets from an ordered list
+// of providers, moving on to the next one when a provider fails or does not
+// have the set. Every provider has its own circuit Breaker: providers whose
+// breaker is open are skipped.
+type Chain struct {
+	// Logger is used to log which providers serve the sets, and the changes
+	// of state of their breakers. If nil, slog.Default() is used.
+	Logger *slog.Logger
+
+	providers []*chainProvider
+
+	servedByMtx sync.RWMutex
+	servedBy    map[int]string
+	// servedOrder are the sets in servedBy, from the first one served.
+	servedOrder []int
+}
+
+// NewChain creates a new Chain trying the given providers, in order.
+func NewChain(providers ...Provider) *Chain {
+	c := &Chain{
+		providers: make([]*chainProvider, len(providers)),
+		servedBy:  make(map[int]string),
+	}
+	for i, p := range providers {
+		c.providers[i] = &chainProvider{
+			Provider: p,
+			breaker:  NewBreaker(),
+			queue:    NewQueue(0),
+		}
+	}
+	return c
+}
+
+// Download downloads a beatmap set from the first provider which has it, and
+// whose breaker is not open. If all providers that were tried don't have the
+// set, ErrNoRedirect is returned; if none could be tried, ErrNoProvider is
+// returned. Providers which are already running as many downloads as their
+// Queue allows are waited for.
+func (c *Chain) Download(ctx context.Context, setID int, noVideo bool) (io.ReadCloser, error) {
+	var (
+		errs        error
+		tried       int
+		unavailable bool
+	)
+	for _, p := range c.providers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !p.breaker.Allow() {
+			continue
+		}
+		tried++
+
+		t, err := p.queue.Acquire(ctx, setID)
+		if err != nil {
+			p.breaker.Discard()
+			return nil, err
+		}
+		start := time.Now()
+		body, err := p.Client.Download(ctx, setID, noVideo)
+		if err != nil {
+			t.Release()
+		}
+		if err != nil && ctx.Err() != nil {
+			// we gave up on the download: it's not the provider's fault.
+			p.breaker.Discard()
+			return nil, err
+		}
+		latency := time.Since(start)
+		providerLatency.Observe(latency.Seconds(), p.Name)
+		if errors.Is(err, ErrNoRedirect) {
+			// the provider is working fine, it just doesn't have the set.
+			c.record(p, nil, latency)
+			providerDownloads.Inc(p.Name, "unavailable")
+			unavailable = true
+			continue
+		}
+		c.record(p, err, latency)
+		if err != nil {
+			providerDownloads.Inc(p.Name, "failed")
+			errs = errors.Join(errs, fmt.Errorf("%s: %w", p.Name, err))
+			continue
+		}
+
+		providerDownloads.Inc(p.Name, "ok")
+		logger(c.Logger).Info("set served by provider", "set_id", setID, "no_video", noVideo, "provider", p.Name)
+		c.servedFrom(setID, p.Name)
+		// the provider is busy until the whole body has been read.
+		return &releaseCloser{ReadCloser: body, t: t}, nil
+	}
+
+	switch {
+	case tried == 0:
+		return nil, ErrNoProvider
+	case errs == nil && unavailable:
+		return nil, ErrNoRedirect
+	}
+	return nil, errs
+}
+
+// servedFrom records that a set has been served by the named provider,
+// forgetting about the set served the longest ago if there are more than
+// maxServedBy.
+func (c *Chain) servedFrom(setID int, name string) {
+	c.servedByMtx.Lock()
+	defer c.servedByMtx.Unlock()
+	if _, ok := c.servedBy[setID]; !ok {
+		if len(c.servedOrder) >= maxServedBy {
+			delete(c.servedBy, c.servedOrder[0])
+			c.servedOrder = c.servedOrder[1:]
+		}
+		c.servedOrder = append(c.servedOrder, setID)
+	}
+	c.servedBy[setID] = name
+}
+
+// ServedBy returns the name of the provider that last served the given set.
+// Only the last maxServedBy sets served are remembered.
+func (c *Chain) ServedBy(setID int) (string, bool) {
+	c.servedByMtx.RLock()
+	defer c.servedByMtx.RUnlock()
+	name, ok := c.servedBy[setID]
+	return name, ok
+}
+
+// record records the result of a call to a provider in its breaker, logging
+// any change to its state.
+func (c *Chain) record(p *chainProvider, err error, latency time.Duration) {
+	before := p.breaker.Status().State
+	p.breaker.Record(err, latency)
+	after := p.breaker.Status().State
+	if before != after {
+		logger(c.Logger).Warn("provider circuit breaker changed state",
+			"provider", p.Name, "state", after.String(), "err", err)
+	}
+}
+
+// Available checks whether there is at least one provider that may be tried.
+func (c *Chain) Available() bool {
+	for _, p := range c.providers {
+		if p.breaker.ready() {
+			return true
+		}
+	}
+	return false
+}
+
+// Breaker returns the circuit breaker of the provider with the given name,
+// so that its settings can be changed.
+func (c *Chain) Breaker(name string) *Breaker {
+	for _, p := range c.providers {
+		if p.Name == name {
+			return p.breaker
+		}
+	}
+	return nil
+}
+
+// Queue returns the queue of the downloads from the provider with the given
+// name, so that its limit can be changed. By default, it has no limit.
+func (c *Chain) Queue(name string) *Queue {
+	for _, p := range c.providers {
+		if p.Name == name {
+			return p.queue
+		}
+	}
+	return nil
+}
+
+// Status returns the status of every provider in the chain.
+func (c *Chain) Status() []ProviderStatus {
+	s := make([]ProviderStatus, len(c.providers))
+	for i, p := range c.providers {
+		s[i] = ProviderStatus{
+			Name:          p.Name,
+			BreakerStatus: p.breaker.Status(),
+			Queue:         p.queue.Status(),
+		}
+	}
+	return s
+}
+
+// releaseCloser releases a Ticket when the ReadCloser is closed.
+type releaseCloser struct {
+	io.ReadCloser
+	t *Ticket
+}
+
+func (r *releaseCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.t.Release()
+	return err
+}
@@ -0,0 +1,134 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClient is a Client which returns the given error, or the set ID as the
+// body if err is nil.
+type fakeClient struct {
+	err   error
+	calls int
+}
+
+func (f *fakeClient) Download(ctx context.Context, setID int, noVideo bool) (io.ReadCloser, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return io.NopCloser(strings.NewReader(fmt.Sprint(setID))), nil
+}
+
+func TestChainFallback(t *testing.T) {
+	broken := &fakeClient{err: errors.New("broken")}
+	missing := &fakeClient{err: ErrNoRedirect}
+	working := &fakeClient{}
+	c := NewChain(
+		Provider{"broken", broken},
+		Provider{"missing", missing},
+		Provider{"working", working},
+	)
+
+	body, err := c.Download(context.Background(), 851, false)
+	require.NoError(t, err)
+	b, _ := io.ReadAll(body)
+	require.Equal(t, "851", string(b))
+
+	name, ok := c.ServedBy(851)
+	require.True(t, ok)
+	require.Equal(t, "working", name)
+	_, ok = c.ServedBy(852)
+	require.False(t, ok)
+}
+
+func TestChainServedByIsBounded(t *testing.T) {
+	c := NewChain()
+	for i := 1; i <= maxServedBy+1; i++ {
+		c.servedFrom(i, "working")
+	}
+	c.servedFrom(2, "other")
+	require.Len(t, c.servedBy, maxServedBy)
+	_, ok := c.ServedBy(1)
+	require.False(t, ok)
+	name, _ := c.ServedBy(2)
+	require.Equal(t, "other", name)
+	_, ok = c.ServedBy(maxServedBy + 1)
+	require.True(t, ok)
+}
+
+func TestChainSkipsUnhealthy(t *testing.T) {
+	broken := &fakeClient{err: errors.New("broken")}
+	working := &fakeClient{}
+	c := NewChain(
+		Provider{"broken", broken},
+		Provider{"working", working},
+	)
+
+	for i := 0; i < DefaultBreakerMinCalls+2; i++ {
+		_, err := c.Download(context.Background(), i, false)
+		require.NoError(t, err)
+	}
+	require.Equal(t, DefaultBreakerMinCalls, broken.calls)
+	require.Equal(t, DefaultBreakerMinCalls+2, working.calls)
+
+	status := c.Status()
+	require.Equal(t, BreakerOpen, status[0].State)
+	require.Equal(t, BreakerClosed, status[1].State)
+}
+
+func TestChainErrors(t *testing.T) {
+	c := NewChain(
+		Provider{"missing1", &fakeClient{err: ErrNoRedirect}},
+		Provider{"missing2", &fakeClient{err: ErrNoRedirect}},
+	)
+	_, err := c.Download(context.Background(), 1, false)
+	require.Equal(t, ErrNoRedirect, err)
+
+	c = NewChain(
+		Provider{"missing", &fakeClient{err: ErrNoRedirect}},
+		Provider{"down", &fakeClient{err: fmt.Errorf("%w: status 503", ErrTemporaryFailure)}},
+	)
+	_, err = c.Download(context.Background(), 1, false)
+	require.ErrorIs(t, err, ErrTemporaryFailure)
+
+	c = NewChain(Provider{"broken", &fakeClient{err: errors.New("broken")}})
+	for i := 0; i < DefaultBreakerMinCalls; i++ {
+		_, err = c.Download(context.Background(), 1, false)
+		require.Error(t, err)
+	}
+	require.False(t, c.Available())
+	_, err = c.Download(context.Background(), 1, false)
+	require.Equal(t, ErrNoProvider, err)
+}
+
+func TestChainConcurrency(t *testing.T) {
+	c := NewChain(Provider{"working", &fakeClient{}})
+	c.Queue("working").SetLimit(1)
+	require.Nil(t, c.Queue("missing"))
+
+	body, err := c.Download(context.Background(), 1, false)
+	require.NoError(t, err)
+
+	// the provider is busy until the body of the first download is closed.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	_, err = c.Download(ctx, 2, false)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, QueueStatus{Limit: 1, Running: 1}, c.Status()[0].Queue)
+	// giving up is not the provider's fault.
+	require.Equal(t, BreakerClosed, c.Status()[0].State)
+
+	require.NoError(t, body.Close())
+	body, err = c.Download(context.Background(), 2, false)
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+	require.Equal(t, QueueStatus{Limit: 1}, c.Status()[0].Queue)
+}
@@ -1,10 +1,11 @@
 package downloader
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math"
 	"strings"
 	"time"
@@ -34,8 +35,15 @@ type Client interface {
 	// HasVideo returns true if the beatmap set has a video.
 	// HasVideo(setID int) (bool, error)
 
-	// Download downloads a beatmap set from the remote source.
-	Download(setID int, noVideo bool) (io.ReadCloser, error)
+	// Download downloads a beatmap set from the remote source. The download,
+	// including reading the returned body, is interrupted when ctx is done.
+	Download(ctx context.Context, setID int, noVideo bool) (io.ReadCloser, error)
+}
+
+// availabler is implemented by Clients which know whether any download could
+// be currently attempted, such as Chain.
+type availabler interface {
+	Available() bool
 }
 
 // Downloader is a wrapper around Client that can download a beatmap.
@@ -43,11 +51,42 @@ type Client interface {
 // This should be used rather than DownloaderClient directly.
 type Downloader struct {
 	Client
+	// Rate, if not nil, limits the speed at which the downloaded files are
+	// read.
+	Rate *RateLimiter
+	// Logger is used to log the retries. If nil, slog.Default() is used.
+	Logger *slog.Logger
+}
+
+// logger returns l, or slog.Default() if it is nil.
+func logger(l *slog.Logger) *slog.Logger {
+	if l != nil {
+		return l
+	}
+	return slog.Default()
 }
 
 // NewDownloader returns a new Downloader wrapping the provided DownloaderClient.
 func NewDownloader(cl Client) *Downloader {
-	return &Downloader{cl}
+	return &Downloader{Client: cl}
+}
+
+// Status returns the status of the providers used by the underlying Client,
+// if it is a Chain.
+func (d *Downloader) Status() []ProviderStatus {
+	if ch, ok := d.Client.(*Chain); ok {
+		return ch.Status()
+	}
+	return nil
+}
+
+// Available checks whether a download could currently be attempted by the
+// underlying Client. Clients which can't tell are always available.
+func (d *Downloader) Available() bool {
+	if av, ok := d.Client.(availabler); ok {
+		return av.Available()
+	}
+	return true
 }
 
 func (d *Downloader) delayForRetry(retries int) time.Duration {
@@ -64,8 +103,10 @@ func (d *Downloader) delayForRetry(retries int) time.Duration {
 // underlying downloaderClient, and checks that the downloaded file is a zip file.
 // If the file is not a zip file, errNoZip is returned.
 // If the underlying downloader returns an error wrapping ErrTemporaryFailure, the request is
-// retries up to maxRetries times with an exponential backoff.
-func (d *Downloader) Download(setID int, noVideo bool) (io.ReadCloser, error) {
+// retries up to maxRetries times with an exponential backoff, unless the
+// underlying Client reports that no provider is currently available or ctx is
+// done.
+func (d *Downloader) Download(ctx context.Context, setID int, noVideo bool) (io.ReadCloser, error) {
 	var body io.ReadCloser
 	var err error
 	var retries int
@@ -73,15 +114,25 @@ func (d *Downloader) Download(setID int, noVideo bool) (io.ReadCloser, error) {
 
 	var downstreamErr error
 	for !ok {
-		body, err = d.Client.Download(setID, noVideo)
+		body, err = d.Client.Download(ctx, setID, noVideo)
 		if errors.Is(err, ErrTemporaryFailure) {
 			downstreamErr = errors.Join(downstreamErr, err)
+			if av, ok := d.Client.(availabler); ok && !av.Available() {
+				// there's no point in waiting: no provider can currently
+				// be tried, so fail fast.
+				return nil, fmt.Errorf("%w. original error: %w", ErrNoProvider, downstreamErr)
+			}
 			if retries >= maxRetries {
 				return nil, fmt.Errorf("too many temporary failures, giving up. original error: %w", downstreamErr)
 			}
 			delay := d.delayForRetry(retries)
-			log.Printf("Temporary failure (%q), retrying in %v", err, delay)
-			time.Sleep(delay)
+			logger(d.Logger).Warn("temporary failure, retrying",
+				"set_id", setID, "no_video", noVideo, "delay", delay, "err", err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, fmt.Errorf("%w. original error: %w", ctx.Err(), downstreamErr)
+			}
 			retries += 1
 			continue
 		}
@@ -95,11 +146,13 @@ func (d *Downloader) Download(setID int, noVideo bool) (io.ReadCloser, error) {
 
 	// check that it is a zip file
 	first4 := make([]byte, 4)
-	_, err = body.Read(first4)
+	_, err = io.ReadFull(body, first4)
 	if err != nil {
+		body.Close()
 		return nil, err
 	}
 	if string(first4) != zipMagic {
+		body.Close()
 		return nil, ErrNoZip
 	}
 
@@ -108,7 +161,7 @@ func (d *Downloader) Download(setID int, noVideo bool) (io.ReadCloser, error) {
 		io.Reader
 		io.Closer
 	}{
-		io.MultiReader(strings.NewReader(zipMagic), body),
+		io.MultiReader(strings.NewReader(zipMagic), d.Rate.Reader(ctx, body)),
 		body,
 	}, nil
 }
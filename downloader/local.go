@@ -0,0 +1,192 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultLocalPatterns are the default patterns used by LocalClient to find
+// the archives of beatmap sets.
+var DefaultLocalPatterns = []string{"<id>.osz", "<id> *.osz"}
+
+// LocalClient is a Client which serves beatmap sets from a read-only
+// directory tree, such as the one of an existing mirror. The tree is indexed
+// when the client is created, and again every time Rescan is called.
+//
+// Files are found using patterns, where <id> stands for the ID of the set,
+// * for any sequence of characters and ? for any single character. Patterns
+// containing a slash are matched against the path of the file relative to the
+// root of the tree, all others against the name of the file only.
+type LocalClient struct {
+	// Logger is used to log the results of Rescan. If nil, slog.Default() is
+	// used.
+	Logger *slog.Logger
+
+	root     string
+	patterns []localPattern
+
+	mtx   sync.RWMutex
+	files map[int]string
+}
+
+// NewLocalClient creates a new LocalClient serving files from root, and
+// indexes the files in it.
+func NewLocalClient(root string, patterns []string) (*LocalClient, error) {
+	c := &LocalClient{root: root}
+	var err error
+	if c.patterns, err = compileLocalPatterns(patterns); err != nil {
+		return nil, err
+	}
+	if err := c.Rescan(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type localPattern struct {
+	re *regexp.Regexp
+	// wholePath is true when the pattern must be matched against the
+	// relative path of the file, rather than its name.
+	wholePath bool
+}
+
+func compileLocalPatterns(patterns []string) ([]localPattern, error) {
+	res := make([]localPattern, 0, len(patterns))
+	for _, p := range patterns {
+		if strings.Count(p, "<id>") != 1 {
+			return nil, fmt.Errorf("cheesegull/downloader: pattern %q must contain <id> exactly once", p)
+		}
+		var b strings.Builder
+		b.WriteByte('^')
+		for i := 0; i < len(p); i++ {
+			switch {
+			case strings.HasPrefix(p[i:], "<id>"):
+				b.WriteString("([0-9]+)")
+				i += len("<id>") - 1
+			case p[i] == '*':
+				b.WriteString(".*")
+			case p[i] == '?':
+				b.WriteByte('.')
+			default:
+				b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+			}
+		}
+		b.WriteByte('$')
+		re, err := regexp.Compile(b.String())
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, localPattern{re: re, wholePath: strings.Contains(p, "/")})
+	}
+	return res, nil
+}
+
+// matchLocalPatterns returns the set ID in rel, if it matches any of the
+// patterns, and the index of the pattern it matched.
+func matchLocalPatterns(patterns []localPattern, rel string) (id, idx int, ok bool) {
+	base := path.Base(rel)
+	for i, p := range patterns {
+		s := base
+		if p.wholePath {
+			s = rel
+		}
+		m := p.re.FindStringSubmatch(s)
+		if m == nil {
+			continue
+		}
+		id, err := strconv.Atoi(m[1])
+		if err != nil {
+			continue
+		}
+		return id, i, true
+	}
+	return 0, 0, false
+}
+
+// Rescan indexes again the files in the directory tree.
+func (c *LocalClient) Rescan() error {
+	files := make(map[int]string)
+	// priority of the pattern that matched each file, so that the files
+	// matching the first patterns are preferred.
+	prio := make(map[int]int)
+
+	err := filepath.WalkDir(c.root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(c.root, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		id, idx, ok := matchLocalPatterns(c.patterns, rel)
+		if !ok {
+			return nil
+		}
+		if old, ok := prio[id]; !ok || idx < old {
+			files[id] = name
+			prio[id] = idx
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logger(c.Logger).Info("indexed local sets", "sets", len(files), "dir", c.root)
+	c.mtx.Lock()
+	c.files = files
+	c.mtx.Unlock()
+	return nil
+}
+
+// Download opens the archive of the set from the directory tree. If the set
+// is not in the tree, ErrNoRedirect is returned. The noVideo flag is ignored,
+// the video is always included.
+func (c *LocalClient) Download(ctx context.Context, setID int, noVideo bool) (io.ReadCloser, error) {
+	c.mtx.RLock()
+	name, ok := c.files[setID]
+	c.mtx.RUnlock()
+	if !ok {
+		return nil, ErrNoRedirect
+	}
+
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		// the file was removed after the last scan.
+		c.mtx.Lock()
+		delete(c.files, setID)
+		c.mtx.Unlock()
+		return nil, ErrNoRedirect
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ctxReadCloser{ctx: ctx, ReadCloser: f}, nil
+}
+
+// ctxReadCloser is a ReadCloser which stops reading once its context is done.
+type ctxReadCloser struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+func (r *ctxReadCloser) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(b)
+}
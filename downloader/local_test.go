@@ -0,0 +1,65 @@
+package downloader
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalClient(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"1.osz":                              "set 1",
+		"a/2 Camellia - Exit This Earth.osz": "set 2",
+		"a/b/3 xi - FREEDOM DiVE.osz":        "set 3",
+		"a/b/3.osz":                          "set 3, first pattern",
+		"4n Nekomata Master - Far east.osz":  "not a match either",
+		"5.zip":                              "not a match",
+		"nested/6/beatmap.osz":               "set 6",
+		"readme.txt":                         "hi",
+	}
+	for name, content := range files {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(name), 0755))
+		require.NoError(t, os.WriteFile(name, []byte(content), 0644))
+	}
+
+	c, err := NewLocalClient(root, append(DefaultLocalPatterns, "nested/<id>/*.osz"))
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		id  int
+		exp string
+	}{
+		{1, "set 1"},
+		{2, "set 2"},
+		{3, "set 3, first pattern"},
+		{6, "set 6"},
+
+		{4, ""},
+		{5, ""},
+	} {
+		r, err := c.Download(context.Background(), tc.id, false)
+		if tc.exp == "" {
+			require.Equal(t, ErrNoRedirect, err, "set %d", tc.id)
+			continue
+		}
+		require.NoError(t, err)
+		b, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.Equal(t, tc.exp, string(b))
+	}
+
+	// removed files are not served anymore
+	require.NoError(t, os.Remove(filepath.Join(root, "1.osz")))
+	_, err = c.Download(context.Background(), 1, false)
+	require.Equal(t, ErrNoRedirect, err)
+
+	_, err = NewLocalClient(root, []string{"*.osz"})
+	require.Error(t, err)
+}
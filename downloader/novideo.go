@@ -0,0 +1,110 @@
+package downloader
+
+import (
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// videoExtensions are the extensions of the files which are always considered
+// videos, even if they are not referenced by any Video event.
+var videoExtensions = map[string]bool{
+	".mp4":  true,
+	".m4v":  true,
+	".avi":  true,
+	".flv":  true,
+	".wmv":  true,
+	".mpg":  true,
+	".mpeg": true,
+	".mkv":  true,
+	".webm": true,
+	".mov":  true,
+}
+
+// StripVideo writes to w a copy of the osz archive in r, without its video
+// files. Videos are the files referenced by the Video events of the .osu and
+// .osb files in the archive, as well as all the files with a video extension.
+// The other files are copied as they are, without being compressed again.
+func StripVideo(w io.Writer, r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("cheesegull/downloader: invalid archive: %w", err)
+	}
+
+	videos := make(map[string]bool)
+	for _, f := range zr.File {
+		ext := strings.ToLower(path.Ext(f.Name))
+		if ext != ".osu" && ext != ".osb" {
+			continue
+		}
+		if err := findVideos(f, videos); err != nil {
+			return fmt.Errorf("cheesegull/downloader: %s: %w", f.Name, err)
+		}
+	}
+
+	zw := zip.NewWriter(w)
+	zw.SetComment(zr.Comment)
+	for _, f := range zr.File {
+		if videos[normaliseOszPath(f.Name)] || videoExtensions[strings.ToLower(path.Ext(f.Name))] {
+			continue
+		}
+		if err := zw.Copy(f); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// findVideos adds to videos the files referenced by the Video events in a
+// .osu or .osb file. The events look like this:
+//
+//	[Events]
+//	Video,0,"video.mp4"
+//	1,0,"video.mp4"
+func findVideos(f *zip.File, videos map[string]bool) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	sc := bufio.NewScanner(rc)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	inEvents := false
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inEvents = line == "[Events]"
+			continue
+		}
+		if !inEvents || !(strings.HasPrefix(line, "Video,") || strings.HasPrefix(line, "1,")) {
+			continue
+		}
+		fields := strings.SplitN(line, ",", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		name := fields[2]
+		// anything after the file name (such as the x and y offsets) is
+		// not relevant.
+		if strings.HasPrefix(name, `"`) {
+			if end := strings.IndexByte(name[1:], '"'); end >= 0 {
+				name = name[1 : end+1]
+			}
+		} else if i := strings.IndexByte(name, ','); i >= 0 {
+			name = name[:i]
+		}
+		videos[normaliseOszPath(name)] = true
+	}
+	return sc.Err()
+}
+
+// normaliseOszPath normalises the path of a file in an osz archive, so that
+// references to it from the .osu files can be compared to the actual name.
+func normaliseOszPath(s string) string {
+	s = strings.ReplaceAll(s, `\`, "/")
+	return strings.ToLower(strings.TrimPrefix(path.Clean("/"+s), "/"))
+}
@@ -0,0 +1,68 @@
+package downloader
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testOsuWithVideo = `osu file format v14
+
+[General]
+AudioFilename: audio.mp3
+
+[Events]
+//Background and Video events
+0,0,"bg.jpg",0,0
+Video,-200,"Media\Intro.MP4"
+1,500,video2.flv
+
+[TimingPoints]
+0,500,4,2,1,60,1,0
+`
+
+func TestStripVideo(t *testing.T) {
+	archive := testArchive(t, map[string]string{
+		"Artist - Title (Mapper) [Easy].osu": testOsuWithVideo,
+		"audio.mp3":                          "music",
+		"bg.jpg":                             "background",
+		"media/intro.mp4":                    "video",
+		"video2.flv":                         "another video",
+		"unreferenced.avi":                   "yet another video",
+		"sb/frame0.png":                      "storyboard",
+	})
+
+	buf := &bytes.Buffer{}
+	r := bytes.NewReader(archive)
+	require.NoError(t, StripVideo(buf, r, r.Size()))
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	require.Equal(t, []string{
+		"Artist - Title (Mapper) [Easy].osu",
+		"audio.mp3",
+		"bg.jpg",
+		"sb/frame0.png",
+	}, names)
+
+	// the files that are kept must be intact
+	for _, f := range zr.File {
+		if f.Name != "bg.jpg" {
+			continue
+		}
+		rc, err := f.Open()
+		require.NoError(t, err)
+		b, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.Equal(t, "background", string(b))
+	}
+}
@@ -4,6 +4,7 @@ package downloader
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -125,12 +126,16 @@ func (c *OsuClient) HasVideo(setID int) (bool, error) {
 
 // Download downloads a beatmap from the osu! website. noVideo specifies whether
 // we should request the beatmap to not have the video.
-func (c *OsuClient) Download(setID int, noVideo bool) (io.ReadCloser, error) {
+func (c *OsuClient) Download(ctx context.Context, setID int, noVideo bool) (io.ReadCloser, error) {
 	suffix := ""
 	if noVideo {
 		suffix = "n"
 	}
-	resp, err := c.httpClient.Get("https://old.ppy.sh/d/" + strconv.Itoa(setID) + suffix)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://old.ppy.sh/d/"+strconv.Itoa(setID)+suffix, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -1,6 +1,7 @@
 package downloader
 
 import (
+	"context"
 	"crypto/md5"
 	"fmt"
 	"io"
@@ -44,21 +45,21 @@ func TestDownload(t *testing.T) {
 	require.NoError(t, err)
 
 	{
-		vid, err := c.Download(1, false)
+		vid, err := c.Download(context.Background(), 1, false)
 		if err != nil {
 			t.Fatal(err)
 		}
 		md5Test(t, vid, "f40fae62893087e72672b3e6d1468a70")
 	}
 	{
-		vid, err := c.Download(100517, false)
+		vid, err := c.Download(context.Background(), 100517, false)
 		if err != nil {
 			t.Fatal(err)
 		}
 		md5Test(t, vid, "500b361f47ff99551dbb9931cdf39ace")
 	}
 	{
-		novid, err := c.Download(100517, true)
+		novid, err := c.Download(context.Background(), 100517, true)
 		if err != nil {
 			t.Fatal(err)
 		}
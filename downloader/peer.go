@@ -0,0 +1,64 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PeerClient is a Client which downloads beatmap sets from another instance
+// of CheeseGull, through its /d/:id endpoint. This way, a CheeseGull instance
+// can fill its cache from another one, rather than from the osu! website.
+type PeerClient struct {
+	// APIKey, if not empty, is sent to the peer in the X-API-Key header, so
+	// that it is not limited like an anonymous client.
+	APIKey string
+
+	httpClient *http.Client
+	baseURL    string
+}
+
+// NewPeerClient returns a new PeerClient downloading from the CheeseGull
+// instance at baseURL (e.g. https://cg.example.com).
+func NewPeerClient(baseURL string) *PeerClient {
+	return &PeerClient{
+		// timeouts are given by the context passed to Download.
+		httpClient: &http.Client{},
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// Download downloads the osz file from the peer. The noVideo flag is ignored,
+// the video is always included.
+func (c *PeerClient) Download(ctx context.Context, setID int, noVideo bool) (io.ReadCloser, error) {
+	u := c.baseURL + "/d/" + strconv.Itoa(setID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound, http.StatusNotAcceptable, http.StatusGatewayTimeout:
+		// The peer doesn't know about the set, doesn't allow downloading it,
+		// or could not download it itself.
+		resp.Body.Close()
+		return nil, ErrNoRedirect
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: status %d", ErrTemporaryFailure, resp.StatusCode)
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("bad status code: %d", resp.StatusCode)
+}
@@ -0,0 +1,57 @@
+package downloader
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/d/1":
+			w.Write([]byte("set 1"))
+		case "/d/2":
+			w.WriteHeader(http.StatusNotAcceptable)
+		case "/d/3":
+			w.WriteHeader(http.StatusGatewayTimeout)
+		case "/d/4":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/d/6":
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	c := NewPeerClient(srv.URL + "/")
+	ctx := context.Background()
+	_, err := c.Download(ctx, 1, false)
+	require.Error(t, err)
+	c.APIKey = "secret"
+
+	r, err := c.Download(ctx, 1, false)
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	r.Close()
+	require.Equal(t, "set 1", string(b))
+
+	for _, id := range []int{2, 3, 5} {
+		_, err := c.Download(ctx, id, false)
+		require.Equal(t, ErrNoRedirect, err)
+	}
+	for _, id := range []int{4, 6} {
+		_, err = c.Download(ctx, id, false)
+		require.ErrorIs(t, err, ErrTemporaryFailure)
+	}
+}
@@ -0,0 +1,192 @@
+package downloader
+
+import (
+	"context"
+	"sync"
+)
+
+// Queue limits the number of downloads running at once. Downloads which can't
+// start right away wait for their turn in a first come, first served order, so
+// that no download is ever overtaken by the ones which came after it. A nil
+// Queue has no limit.
+type Queue struct {
+	mtx     sync.Mutex
+	limit   int
+	running int
+	waiting []*Ticket
+}
+
+// QueueStatus describes the downloads in a Queue.
+type QueueStatus struct {
+	Limit   int
+	Running int
+	Waiting int
+}
+
+// NewQueue creates a new Queue running at most limit downloads at once. If
+// limit is 0, the Queue has no limit.
+func NewQueue(limit int) *Queue {
+	return &Queue{limit: limit}
+}
+
+// Ticket is the place of a download in a Queue.
+type Ticket struct {
+	q     *Queue
+	setID int
+	ready chan struct{}
+	// done is set once the ticket has been released.
+	done bool
+}
+
+// SetLimit changes the maximum number of downloads running at once. If the
+// limit is raised, the downloads waiting for it start right away; if it is
+// lowered, the running downloads are not interrupted.
+func (q *Queue) SetLimit(limit int) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.limit = limit
+	q.startWaiting()
+}
+
+// Enqueue adds the download of a set to the queue. The download may start
+// once Wait returns, and Release must be called once it is over.
+func (q *Queue) Enqueue(setID int) *Ticket {
+	t := &Ticket{q: q, setID: setID, ready: make(chan struct{})}
+	if q == nil {
+		close(t.ready)
+		return t
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.limit <= 0 || q.running < q.limit {
+		q.running++
+		close(t.ready)
+	} else {
+		q.waiting = append(q.waiting, t)
+	}
+	return t
+}
+
+// Acquire adds the download of a set to the queue and waits for its turn.
+func (q *Queue) Acquire(ctx context.Context, setID int) (*Ticket, error) {
+	t := q.Enqueue(setID)
+	if err := t.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Wait waits until the download may start. If ctx is done first, the ticket
+// leaves the queue and ctx's error is returned.
+func (t *Ticket) Wait(ctx context.Context) error {
+	select {
+	case <-t.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	if t.q == nil {
+		return ctx.Err()
+	}
+	t.q.mtx.Lock()
+	defer t.q.mtx.Unlock()
+	select {
+	case <-t.ready:
+		// the download was started right as ctx was done.
+		return nil
+	default:
+	}
+	if !t.done {
+		t.done = true
+		t.q.remove(t)
+	}
+	return ctx.Err()
+}
+
+// Position returns the position of the ticket in the queue, starting from 1,
+// or 0 if the download may start.
+func (t *Ticket) Position() int {
+	if t.q == nil {
+		return 0
+	}
+	t.q.mtx.Lock()
+	defer t.q.mtx.Unlock()
+	for i, w := range t.q.waiting {
+		if w == t {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Release frees the place of the ticket in the queue, letting the next
+// download start. Calling it more than once does nothing.
+func (t *Ticket) Release() {
+	q := t.q
+	if q == nil {
+		return
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if t.done {
+		return
+	}
+	t.done = true
+
+	select {
+	case <-t.ready:
+		q.running--
+	default:
+		// the ticket was still waiting: it just leaves the queue.
+		q.remove(t)
+		return
+	}
+	q.startWaiting()
+}
+
+// startWaiting starts the first waiting downloads, as long as the limit
+// allows it. It must be called with q.mtx held.
+func (q *Queue) startWaiting() {
+	for len(q.waiting) > 0 && (q.limit <= 0 || q.running < q.limit) {
+		next := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.running++
+		close(next.ready)
+	}
+}
+
+// remove removes a waiting ticket from the queue. It must be called with
+// q.mtx held.
+func (q *Queue) remove(t *Ticket) {
+	for i, w := range q.waiting {
+		if w == t {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// Position returns the position in the queue of the first download of the
+// given set which is waiting to start, or 0 if there is none.
+func (q *Queue) Position(setID int) int {
+	if q == nil {
+		return 0
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for i, w := range q.waiting {
+		if w.setID == setID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Status returns the number of downloads which are running and waiting.
+func (q *Queue) Status() QueueStatus {
+	if q == nil {
+		return QueueStatus{}
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return QueueStatus{Limit: q.limit, Running: q.running, Waiting: len(q.waiting)}
+}
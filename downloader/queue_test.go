@@ -0,0 +1,58 @@
+package downloader
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueue(t *testing.T) {
+	q := NewQueue(2)
+	t1 := q.Enqueue(1)
+	t2 := q.Enqueue(2)
+	t3 := q.Enqueue(3)
+	t4 := q.Enqueue(4)
+	require.NoError(t, t1.Wait(context.Background()))
+	require.NoError(t, t2.Wait(context.Background()))
+	require.Equal(t, 0, t1.Position())
+	require.Equal(t, 1, t3.Position())
+	require.Equal(t, 2, q.Position(4))
+	require.Equal(t, 0, q.Position(5))
+	require.Equal(t, QueueStatus{Limit: 2, Running: 2, Waiting: 2}, q.Status())
+
+	// the waiting downloads start in order.
+	t1.Release()
+	t1.Release()
+	require.NoError(t, t3.Wait(context.Background()))
+	require.Equal(t, 1, t4.Position())
+	require.Equal(t, QueueStatus{Limit: 2, Running: 2, Waiting: 1}, q.Status())
+
+	// downloads that are given up on leave the queue.
+	t5 := q.Enqueue(5)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	require.ErrorIs(t, t4.Wait(ctx), context.DeadlineExceeded)
+	require.Equal(t, 1, t5.Position())
+	t4.Release()
+	require.Equal(t, QueueStatus{Limit: 2, Running: 2, Waiting: 1}, q.Status())
+
+	q.SetLimit(3)
+	require.NoError(t, t5.Wait(context.Background()))
+	t2.Release()
+	t3.Release()
+	t5.Release()
+	require.Equal(t, QueueStatus{Limit: 3}, q.Status())
+}
+
+func TestQueueUnlimited(t *testing.T) {
+	for _, q := range []*Queue{nil, NewQueue(0)} {
+		for i := 0; i < 10; i++ {
+			tk, err := q.Acquire(context.Background(), i)
+			require.NoError(t, err)
+			require.Equal(t, 0, tk.Position())
+		}
+		require.Equal(t, 0, q.Position(1))
+	}
+}
@@ -0,0 +1,81 @@
+package downloader
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the speed at which downloads are read. The limit is
+// shared among all of the readers of the RateLimiter. A nil RateLimiter has no
+// limit.
+type RateLimiter struct {
+	mtx  sync.Mutex
+	rate int64
+	// next is the time at which the bytes read so far will be within the
+	// limit.
+	next time.Time
+}
+
+// NewRateLimiter creates a RateLimiter allowing bytesPerSecond bytes to be
+// read every second. If bytesPerSecond is 0, it returns nil.
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{rate: bytesPerSecond}
+}
+
+// Reader returns a reader reading from r within the limit. Reads return ctx's
+// error if ctx is done while waiting.
+func (l *RateLimiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &rateLimitedReader{ctx: ctx, r: r, l: l}
+}
+
+// reserve records that n bytes have been read, and returns how long to wait
+// for them to be within the limit.
+func (l *RateLimiter) reserve(n int) time.Duration {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	return l.next.Sub(now)
+}
+
+type rateLimitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *RateLimiter
+}
+
+func (r *rateLimitedReader) Read(b []byte) (int, error) {
+	// never read more than a tenth of a second worth of data at once, so
+	// that the speed is even.
+	if limit := r.l.rate/10 + 1; int64(len(b)) > limit {
+		b = b[:limit]
+	}
+	n, err := r.r.Read(b)
+	if n == 0 {
+		return n, err
+	}
+
+	wait := r.l.reserve(n)
+	if wait <= 0 {
+		return n, err
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return n, err
+	case <-r.ctx.Done():
+		return n, r.ctx.Err()
+	}
+}
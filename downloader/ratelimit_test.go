@@ -0,0 +1,41 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	const rate = 100000
+	l := NewRateLimiter(rate)
+
+	// the limit is shared among all the readers.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := io.Copy(io.Discard, l.Reader(context.Background(), bytes.NewReader(make([]byte, rate/8))))
+			require.NoError(t, err)
+			require.Equal(t, int64(rate/8), n)
+		}()
+	}
+	wg.Wait()
+	require.GreaterOrEqual(t, time.Since(start), time.Millisecond*200)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := io.Copy(io.Discard, l.Reader(ctx, bytes.NewReader(make([]byte, rate))))
+	require.ErrorIs(t, err, context.Canceled)
+
+	require.Nil(t, NewRateLimiter(0))
+	r := bytes.NewReader(nil)
+	require.Equal(t, io.Reader(r), (*RateLimiter)(nil).Reader(ctx, r))
+}
@@ -0,0 +1,112 @@
+package downloader
+
+import (
+	"archive/zip"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// VerifyMode specifies what to do with the result of the verification of a
+// downloaded archive.
+type VerifyMode int
+
+// These are the possible verification modes.
+const (
+	// VerifyOff disables verification.
+	VerifyOff VerifyMode = iota
+	// VerifyReport verifies archives, only reporting mismatches.
+	VerifyReport
+	// VerifyReject verifies archives, rejecting the ones that don't match.
+	VerifyReject
+)
+
+// ParseVerifyMode parses the name of a VerifyMode (off, report or reject).
+func ParseVerifyMode(s string) (VerifyMode, error) {
+	switch s {
+	case "off":
+		return VerifyOff, nil
+	case "report":
+		return VerifyReport, nil
+	case "reject":
+		return VerifyReject, nil
+	}
+	return VerifyOff, fmt.Errorf("cheesegull/downloader: unknown verify mode %q", s)
+}
+
+// VerifyResult is the result of the verification of an osz archive.
+type VerifyResult struct {
+	// Missing contains the MD5s of the beatmaps which were expected to be in
+	// the archive, but were not found.
+	Missing []string
+	// Unexpected contains the names of the .osu files in the archive whose
+	// MD5 was not expected.
+	Unexpected []string
+}
+
+// OK returns whether the archive matches exactly what was expected.
+func (r VerifyResult) OK() bool {
+	return len(r.Missing) == 0 && len(r.Unexpected) == 0
+}
+
+func (r VerifyResult) String() string {
+	if r.OK() {
+		return "OK"
+	}
+	return fmt.Sprintf("missing MD5s %v, unexpected files %q", r.Missing, r.Unexpected)
+}
+
+// Verify opens an osz archive and hashes every .osu file in it, matching them
+// against the expected MD5s (such as the FileMD5 of the beatmaps of the set).
+// An error is returned if the archive can't be read, for instance because it
+// is truncated.
+func Verify(r io.ReaderAt, size int64, expected []string) (VerifyResult, error) {
+	var res VerifyResult
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return res, fmt.Errorf("cheesegull/downloader: invalid archive: %w", err)
+	}
+
+	found := make(map[string]bool, len(expected))
+	for _, md5 := range expected {
+		found[strings.ToLower(md5)] = false
+	}
+
+	for _, f := range zr.File {
+		if !strings.EqualFold(path.Ext(f.Name), ".osu") {
+			continue
+		}
+		sum, err := md5File(f)
+		if err != nil {
+			return res, fmt.Errorf("cheesegull/downloader: invalid archive: %s: %w", f.Name, err)
+		}
+		if _, ok := found[sum]; !ok {
+			res.Unexpected = append(res.Unexpected, f.Name)
+			continue
+		}
+		found[sum] = true
+	}
+
+	for _, md5 := range expected {
+		if !found[strings.ToLower(md5)] {
+			res.Missing = append(res.Missing, md5)
+		}
+	}
+	return res, nil
+}
+
+func md5File(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,54 @@
+package downloader
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testArchive creates a zip archive containing the given files.
+func testArchive(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestVerify(t *testing.T) {
+	archive := testArchive(t, map[string]string{
+		"Artist - Title (Mapper) [Easy].osu":   "easy",
+		"Artist - Title (Mapper) [Normal].osu": "normal",
+		"audio.mp3":                            "music",
+	})
+	r := bytes.NewReader(archive)
+
+	res, err := Verify(r, r.Size(), []string{md5Hex("easy"), md5Hex("normal")})
+	require.NoError(t, err)
+	require.True(t, res.OK())
+
+	res, err = Verify(r, r.Size(), []string{md5Hex("easy"), md5Hex("insane")})
+	require.NoError(t, err)
+	require.False(t, res.OK())
+	require.Equal(t, []string{md5Hex("insane")}, res.Missing)
+	require.Equal(t, []string{"Artist - Title (Mapper) [Normal].osu"}, res.Unexpected)
+
+	// truncated archive
+	truncated := bytes.NewReader(archive[:len(archive)/2])
+	_, err = Verify(truncated, truncated.Size(), []string{md5Hex("easy")})
+	require.Error(t, err)
+}
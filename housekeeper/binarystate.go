@@ -2,11 +2,18 @@ package housekeeper
 
 import (
 	"encoding"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
-const cachedBeatmapBinSize = 8 + 1 + 15 + 15 + 8
+const cachedBeatmapBinSize = 8 + 1 + 15 + 15 + 8 + 1 + 8 + 1
 
 func b2i(b bool) byte {
 	if b {
@@ -33,25 +40,100 @@ func putUint64(b []byte, v uint64) {
 	b[7] = byte(v)
 }
 
+// The cgbin file starts with a header made of the magic string, the size of
+// each record, the number of records and the CRC32 of all the previous fields.
+// Every record is followed by its own CRC32, so that corrupt records can be
+// detected and skipped without losing the rest of the file. Records may grow
+// in future versions: readers ignore the fields they don't know about.
+const (
+	cgbinMagic      = "CGBIN002"
+	cgbinHeaderSize = 8 + 2 + 4 + 4
+	// cgbinV1Magic is the magic string of the first version of cgbin, which
+	// had no checksums and no record count, and is only read for migration.
+	cgbinV1Magic = "CGBIN001"
+	// minBinSize is the minimum size of a record that can be read.
+	minBinSize = 8 + 1 + 15 + 15 + 8
+)
+
 func writeBeatmaps(w io.Writer, c []*CachedBeatmap) error {
-	_, err := w.Write(append([]byte("CGBIN001"), cachedBeatmapBinSize))
+	// the records are encoded before the header, as the beatmaps may finish
+	// downloading in the meantime, and the count must match the records.
+	const recordSize = cachedBeatmapBinSize + 4
+	records := make([]byte, 0, len(c)*recordSize)
+	enc := make([]byte, recordSize)
+	for _, b := range c {
+		if b != nil && b.encode(enc) {
+			records = append(records, enc...)
+		}
+	}
+
+	header := make([]byte, cgbinHeaderSize)
+	copy(header, cgbinMagic)
+	binary.BigEndian.PutUint16(header[8:10], cachedBeatmapBinSize)
+	binary.BigEndian.PutUint32(header[10:14], uint32(len(records)/recordSize))
+	binary.BigEndian.PutUint32(header[14:18], crc32.ChecksumIEEE(header[:14]))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(records)
+	return err
+}
+
+// encode writes the record of the beatmap into enc, holding its lock so that
+// the record is consistent. It returns false, writing nothing, if the beatmap
+// is not downloaded.
+func (c *CachedBeatmap) encode(enc []byte) bool {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	if !c.isDownloaded {
+		return false
+	}
+	const crcStart = cachedBeatmapBinSize
+	putUint64(enc[:8], uint64(c.ID))
+	enc[8] = b2i(c.NoVideo)
+	marshalBinaryCopy(enc[9:24], c.LastUpdate)
+	marshalBinaryCopy(enc[24:39], c.lastRequested)
+	putUint64(enc[39:47], c.fileSize)
+	enc[47] = byte(c.verification)
+	putUint64(enc[48:56], c.requests)
+	enc[56] = byte(int8(c.RankedStatus))
+	binary.BigEndian.PutUint32(enc[crcStart:], crc32.ChecksumIEEE(enc[:crcStart]))
+	return true
+}
+
+// writeFileAtomic writes data to the file with the given name, replacing it
+// only once the data has been completely written and synced to disk, so that
+// a crash never leaves a half-written file behind.
+func writeFileAtomic(name string, data []byte) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp*")
 	if err != nil {
 		return err
 	}
-	for _, b := range c {
-		if b == nil || !b.isDownloaded {
-			continue
-		}
-		enc := make([]byte, cachedBeatmapBinSize)
-		putUint64(enc[:8], uint64(b.ID))
-		enc[8] = b2i(b.NoVideo)
-		marshalBinaryCopy(enc[9:24], b.LastUpdate)
-		marshalBinaryCopy(enc[24:39], b.lastRequested)
-		putUint64(enc[39:47], b.fileSize)
-		_, err := w.Write(enc)
+	defer func() {
 		if err != nil {
-			return err
+			f.Close()
+			os.Remove(f.Name())
 		}
+	}()
+
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), name); err != nil {
+		return err
+	}
+
+	// make sure the rename itself is persisted. Not all platforms allow
+	// syncing directories, so errors are ignored.
+	if dir, err := os.Open(filepath.Dir(name)); err == nil {
+		dir.Sync()
+		dir.Close()
 	}
 	return nil
 }
@@ -71,43 +153,184 @@ func readCachedBeatmap(b []byte) *CachedBeatmap {
 	(&m.LastUpdate).UnmarshalBinary(b[9:24])
 	(&m.lastRequested).UnmarshalBinary(b[24:39])
 	m.fileSize = readUint64(b[39:47])
+	// older versions of cgbin did not store the verification.
+	if len(b) > 47 {
+		m.verification = Verification(b[47])
+	}
+	if len(b) >= 56 {
+		m.requests = readUint64(b[48:56])
+	}
+	m.RankedStatus = UnknownStatus
+	if len(b) >= 57 {
+		m.RankedStatus = int(int8(b[56]))
+	}
 	m.isDownloaded = true
 	return m
 }
 
+// CorruptStateError is returned when some of the records of the cgbin file
+// could not be read. The beatmaps in the records which could be read are
+// returned alongside it.
+type CorruptStateError struct {
+	// Records are the positions in the file of the corrupt records, starting
+	// from 0.
+	Records []int
+	// Missing is the number of records which should have followed the last
+	// one in the file, which was likely truncated.
+	Missing int
+}
+
+func (e *CorruptStateError) Error() string {
+	var parts []string
+	if len(e.Records) > 0 {
+		s := make([]string, len(e.Records))
+		for i, r := range e.Records {
+			s[i] = strconv.Itoa(r)
+		}
+		parts = append(parts, fmt.Sprintf("%d corrupt records (%s)", len(e.Records), strings.Join(s, ", ")))
+	}
+	if e.Missing > 0 {
+		parts = append(parts, fmt.Sprintf("%d missing records", e.Missing))
+	}
+	return "cheesegull/housekeeper: corrupt cgbin file: " + strings.Join(parts, ", ")
+}
+
 func readBeatmaps(r io.Reader) ([]*CachedBeatmap, error) {
-	b := make([]byte, 8)
-	_, err := r.Read(b)
-	if err != nil {
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(r, magic); err != nil {
 		return nil, err
 	}
-	if string(b) != "CGBIN001" {
+	switch string(magic) {
+	case cgbinMagic:
+	case cgbinV1Magic:
+		return readBeatmapsV1(r)
+	default:
 		return nil, errors.New("cheesegull/housekeeper: unknown cgbin version")
 	}
 
-	b = make([]byte, 1)
-	_, err = r.Read(b)
-	if err != nil {
+	header := make([]byte, cgbinHeaderSize)
+	copy(header, magic)
+	if _, err := io.ReadFull(r, header[8:]); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(header[:14]) != binary.BigEndian.Uint32(header[14:18]) {
+		return nil, errors.New("cheesegull/housekeeper: cgbin header checksum mismatch")
+	}
+	bmLength := int(binary.BigEndian.Uint16(header[8:10]))
+	count := int(binary.BigEndian.Uint32(header[10:14]))
+	if bmLength < minBinSize {
+		return nil, fmt.Errorf("cheesegull/housekeeper: cgbin records are too short (%d bytes)", bmLength)
+	}
+
+	var (
+		corrupt  CorruptStateError
+		b        = make([]byte, bmLength+4)
+		beatmaps = make([]*CachedBeatmap, 0, count)
+	)
+	for i := 0; i < count; i++ {
+		_, err := io.ReadFull(r, b)
+		switch {
+		case err == io.EOF:
+			corrupt.Missing = count - i
+		case err == io.ErrUnexpectedEOF:
+			corrupt.Records = append(corrupt.Records, i)
+			corrupt.Missing = count - i - 1
+		case err != nil:
+			return nil, err
+		case crc32.ChecksumIEEE(b[:bmLength]) != binary.BigEndian.Uint32(b[bmLength:]):
+			corrupt.Records = append(corrupt.Records, i)
+			continue
+		default:
+			beatmaps = append(beatmaps, readCachedBeatmap(b[:bmLength]))
+			continue
+		}
+		break
+	}
+	if len(corrupt.Records) > 0 || corrupt.Missing > 0 {
+		return beatmaps, &corrupt
+	}
+	return beatmaps, nil
+}
+
+// readBeatmapsV1 reads the records of a CGBIN001 file, after the magic string.
+func readBeatmapsV1(r io.Reader) ([]*CachedBeatmap, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
 		return nil, err
 	}
 
-	bmLength := b[0]
+	bmLength := int(b[0])
 	if bmLength == 0 {
 		return nil, nil
 	}
+	if bmLength < minBinSize {
+		return nil, fmt.Errorf("cheesegull/housekeeper: cgbin records are too short (%d bytes)", bmLength)
+	}
 	b = make([]byte, bmLength)
 	beatmaps := make([]*CachedBeatmap, 0, 50)
 
 	for {
-		read, err := r.Read(b)
+		_, err := io.ReadFull(r, b)
 		switch {
 		case err == io.EOF:
 			return beatmaps, nil
+		case err == io.ErrUnexpectedEOF:
+			// without checksums, a truncated last record is the only
+			// corruption we can detect.
+			return beatmaps, &CorruptStateError{Records: []int{len(beatmaps)}}
 		case err != nil:
 			return nil, err
-		case byte(read) != bmLength:
-			return beatmaps, nil
 		}
 		beatmaps = append(beatmaps, readCachedBeatmap(b))
 	}
 }
+
+// The pinned sets are written after the beatmaps, in a section made of the
+// magic string, the number of pinned sets, their IDs and the CRC32 of all the
+// previous fields of the section. Files without it have no pinned sets.
+const pinsMagic = "PINS"
+
+func writePins(w io.Writer, pins []int) error {
+	enc := make([]byte, 4+4+8*len(pins)+4)
+	copy(enc, pinsMagic)
+	binary.BigEndian.PutUint32(enc[4:8], uint32(len(pins)))
+	for i, id := range pins {
+		putUint64(enc[8+8*i:], uint64(id))
+	}
+	crcStart := len(enc) - 4
+	binary.BigEndian.PutUint32(enc[crcStart:], crc32.ChecksumIEEE(enc[:crcStart]))
+	_, err := w.Write(enc)
+	return err
+}
+
+func readPins(r io.Reader) ([]int, error) {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(r, header)
+	switch {
+	case err == io.EOF:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	case string(header[:4]) != pinsMagic:
+		return nil, errors.New("cheesegull/housekeeper: unknown section in cgbin file")
+	}
+
+	n := binary.BigEndian.Uint32(header[4:8])
+	if n > 1<<24 {
+		return nil, errors.New("cheesegull/housekeeper: corrupt pins section in cgbin file")
+	}
+	enc := make([]byte, 8+8*int(n)+4)
+	copy(enc, header)
+	if _, err := io.ReadFull(r, enc[8:]); err != nil {
+		return nil, err
+	}
+	crcStart := len(enc) - 4
+	if crc32.ChecksumIEEE(enc[:crcStart]) != binary.BigEndian.Uint32(enc[crcStart:]) {
+		return nil, errors.New("cheesegull/housekeeper: corrupt pins section in cgbin file")
+	}
+	pins := make([]int, n)
+	for i := range pins {
+		pins[i] = int(readUint64(enc[8+8*i:]))
+	}
+	return pins, nil
+}
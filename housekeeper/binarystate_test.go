@@ -2,6 +2,9 @@ package housekeeper
 
 import (
 	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -15,17 +18,20 @@ var testBeatmaps = []*CachedBeatmap{
 	{
 		ID:           851,
 		NoVideo:      true,
+		RankedStatus: -2,
 		isDownloaded: true,
 	},
 	{
 		ID:           1337777,
 		fileSize:     58111,
 		isDownloaded: true,
+		verification: VerificationPassed,
 	},
 	{
 		ID:            851,
 		LastUpdate:    time.Date(2017, 9, 21, 11, 11, 50, 0, time.UTC),
 		lastRequested: time.Date(2017, 9, 21, 22, 11, 50, 0, time.UTC),
+		requests:      42,
 		isDownloaded:  true,
 	},
 }
@@ -47,6 +53,125 @@ func TestEncodeDecode(t *testing.T) {
 	require.Equal(t, readBMs, testBeatmaps)
 }
 
+// encodeV1 encodes beatmaps in the CGBIN001 format, using records of the
+// given size.
+func encodeV1(bms []*CachedBeatmap, size int) []byte {
+	buf := &bytes.Buffer{}
+	writeBeatmaps(buf, bms)
+	enc := buf.Bytes()[cgbinHeaderSize:]
+
+	res := append([]byte(cgbinV1Magic), byte(size))
+	for len(enc) > 0 {
+		res = append(res, enc[:size]...)
+		enc = enc[cachedBeatmapBinSize+4:]
+	}
+	return res
+}
+
+func TestReadV1(t *testing.T) {
+	// CGBIN001 did not store the number of requests.
+	readBMs, err := readBeatmaps(bytes.NewReader(encodeV1(testBeatmaps, 48)))
+	require.NoError(t, err)
+	require.Len(t, readBMs, len(testBeatmaps))
+	for i, b := range readBMs {
+		require.Equal(t, testBeatmaps[i].key(), b.key())
+		require.Equal(t, testBeatmaps[i].verification, b.verification)
+		require.Zero(t, b.requests)
+	}
+
+	// the first version of CGBIN001 did not store the verification.
+	readBMs, err = readBeatmaps(bytes.NewReader(encodeV1(testBeatmaps, 47)))
+	require.NoError(t, err)
+	require.Len(t, readBMs, len(testBeatmaps))
+	require.Equal(t, NotVerified, readBMs[2].verification)
+	require.Equal(t, testBeatmaps[2].fileSize, readBMs[2].fileSize)
+
+	// truncated files must not go unnoticed.
+	enc := encodeV1(testBeatmaps, 48)
+	readBMs, err = readBeatmaps(bytes.NewReader(enc[:len(enc)-10]))
+	require.Equal(t, &CorruptStateError{Records: []int{3}}, err)
+	require.Len(t, readBMs, 3)
+}
+
+func TestReadCorrupt(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeBeatmaps(buf, testBeatmaps))
+	enc := buf.Bytes()
+	const recordSize = cachedBeatmapBinSize + 4
+
+	// flip a byte in the second record, and truncate the last one.
+	enc[cgbinHeaderSize+recordSize+5] ^= 0xff
+	enc = enc[:len(enc)-recordSize/2]
+
+	readBMs, err := readBeatmaps(bytes.NewReader(enc))
+	require.Equal(t, &CorruptStateError{Records: []int{1, 3}}, err)
+	require.EqualError(t, err, "cheesegull/housekeeper: corrupt cgbin file: 2 corrupt records (1, 3)")
+	require.Equal(t, []*CachedBeatmap{testBeatmaps[0], testBeatmaps[2]}, readBMs)
+
+	// records missing altogether are reported as well.
+	readBMs, err = readBeatmaps(bytes.NewReader(buf.Bytes()[:cgbinHeaderSize+recordSize]))
+	require.Equal(t, &CorruptStateError{Missing: 3}, err)
+	require.Equal(t, testBeatmaps[:1], readBMs)
+
+	// a corrupt header makes the whole file unreadable.
+	enc = append([]byte(nil), buf.Bytes()...)
+	enc[10] ^= 0xff
+	_, err = readBeatmaps(bytes.NewReader(enc))
+	require.EqualError(t, err, "cheesegull/housekeeper: cgbin header checksum mismatch")
+}
+
+func TestSaveState(t *testing.T) {
+	dir := t.TempDir()
+	h := New(filepath.Join(dir, "cgbin.db"))
+	h.setState(testBeatmaps)
+	// static pins are not saved.
+	h.StaticPins = map[int]bool{42: true}
+	require.NoError(t, h.Pin(851))
+	require.NoError(t, h.Pin(1000))
+	require.NoError(t, h.Unpin(1000))
+
+	h.setState(testBeatmaps[:2])
+	require.NoError(t, h.SaveState())
+
+	// no temporary files must be left behind.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	h2 := New(h.FilePath)
+	h2.Storage = nil
+	require.NoError(t, h2.LoadState())
+	require.Equal(t, testBeatmaps[:2], h2.Beatmaps())
+	require.Equal(t, []int{851}, h2.Pins())
+}
+
+func TestSaveStateConcurrent(t *testing.T) {
+	h := New(filepath.Join(t.TempDir(), "cgbin.db"))
+	b, _ := h.AcquireBeatmap(&CachedBeatmap{ID: 1})
+	b.DownloadCompleted(1000, h)
+
+	// the beatmap is used while the state is saved: run with -race.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			h.Requested(b)
+			b.SetRankedStatus(1)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, h.SaveState())
+	}
+	wg.Wait()
+
+	require.NoError(t, h.SaveState())
+	h2 := New(h.FilePath)
+	require.NoError(t, h2.LoadState())
+	require.Len(t, h2.Beatmaps(), 1)
+	require.Equal(t, uint64(100), h2.Beatmaps()[0].Requests())
+}
+
 func BenchmarkWriteBinaryState(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		if err := writeBeatmaps(fakeWriter{}, testBeatmaps); err != nil {
@@ -0,0 +1,55 @@
+package housekeeper
+
+import (
+	"context"
+)
+
+// startedDownload records that b is being downloaded.
+func (h *House) startedDownload(b *CachedBeatmap) {
+	h.downloadsMutex.Lock()
+	if h.downloads == nil {
+		h.downloads = make(map[*CachedBeatmap]bool)
+	}
+	h.downloads[b] = true
+	h.downloadsMutex.Unlock()
+}
+
+// finishedDownload records that the download of b is over.
+func (h *House) finishedDownload(b *CachedBeatmap) {
+	h.downloadsMutex.Lock()
+	delete(h.downloads, b)
+	if len(h.downloads) == 0 && h.downloadsIdle != nil {
+		close(h.downloadsIdle)
+		h.downloadsIdle = nil
+	}
+	h.downloadsMutex.Unlock()
+}
+
+// Downloading returns the number of beatmaps being downloaded.
+func (h *House) Downloading() int {
+	h.downloadsMutex.Lock()
+	defer h.downloadsMutex.Unlock()
+	return len(h.downloads)
+}
+
+// WaitDownloads waits until no beatmap is being downloaded, or until ctx is
+// done, in which case its error is returned.
+func (h *House) WaitDownloads(ctx context.Context) error {
+	h.downloadsMutex.Lock()
+	if len(h.downloads) == 0 {
+		h.downloadsMutex.Unlock()
+		return nil
+	}
+	if h.downloadsIdle == nil {
+		h.downloadsIdle = make(chan struct{})
+	}
+	idle := h.downloadsIdle
+	h.downloadsMutex.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,40 @@
+package housekeeper
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitDownloads(t *testing.T) {
+	h := New(newTestFolder(t).path)
+	h.Storage = LocalStorage(t.TempDir())
+	require.NoError(t, h.WaitDownloads(context.Background()))
+
+	a, ok := h.AcquireBeatmap(&CachedBeatmap{ID: 1})
+	require.True(t, ok)
+	b, ok := h.AcquireBeatmap(&CachedBeatmap{ID: 2})
+	require.True(t, ok)
+	require.Equal(t, 2, h.Downloading())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	require.ErrorIs(t, h.WaitDownloads(ctx), context.DeadlineExceeded)
+
+	done := make(chan error)
+	go func() {
+		done <- h.WaitDownloads(context.Background())
+	}()
+	a.DownloadCompleted(20000, h)
+	select {
+	case <-done:
+		t.Fatal("WaitDownloads returned with a download still running")
+	case <-time.After(time.Millisecond * 10):
+	}
+	b.DownloadFailed(errors.New("failed"), h)
+	require.NoError(t, <-done)
+	require.Equal(t, 0, h.Downloading())
+}
@@ -3,22 +3,64 @@
 package housekeeper
 
 import (
-	"log"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
 	"os"
 	"sort"
 	"sync"
+	"time"
 
 	raven "github.com/getsentry/raven-go"
+
+	"github.com/osuripple/cheesegull/metrics"
+)
+
+var (
+	evictions = metrics.NewCounter("cheesegull_cache_evictions_total",
+		"Number of beatmaps removed from the cache.")
+	evictedBytes = metrics.NewCounter("cheesegull_cache_evicted_bytes_total",
+		"Number of bytes of the beatmaps removed from the cache.")
 )
 
-// House manages the state of the cached beatmaps in the local filesystem.
+// House manages the state of the cached beatmaps, which are kept in Storage.
 type House struct {
-	FilePath    string
-	MaxSize     uint64
-	state       []*CachedBeatmap
-	stateMutex  sync.RWMutex
+	FilePath string
+	MaxSize  uint64
+	Storage  Storage
+	Policy   Policy
+	// Quotas are the maximum number of bytes which may be used by the
+	// beatmaps of each ranked status. Ranked statuses without a quota are
+	// only limited by MaxSize.
+	Quotas map[int]uint64
+	// StaticPins are the sets which are pinned by the configuration. Unlike
+	// the sets pinned with Pin, they are not saved in the state file, so
+	// they are unpinned once they are removed from the configuration.
+	StaticPins map[int]bool
+	// Logger is used to log what the House does. If nil, slog.Default() is
+	// used.
+	Logger    *slog.Logger
+	state     [stateShards]stateShard
+	pins      map[int]bool
+	pinsMutex sync.RWMutex
+	// fileMutex makes sure the state file is written by one goroutine at a
+	// time, so that an older state never replaces a newer one.
+	fileMutex   sync.Mutex
 	requestChan chan struct{}
-	// set to non-nil to avoid calling os.Remove on the files to remove, and
+	// downloads are the beatmaps being downloaded. downloadsIdle, if not nil,
+	// is closed once there are none left.
+	downloads      map[*CachedBeatmap]bool
+	downloadsIdle  chan struct{}
+	downloadsMutex sync.Mutex
+	// storageChecked is when CheckStorage last checked the Storage, and
+	// storageCheckErr the result.
+	storageChecked    time.Time
+	storageCheckErr   error
+	storageCheckMutex sync.Mutex
+	// set to non-nil to avoid calling Storage.Remove on the files to remove, and
 	// place them here instead.
 	dryRun []*CachedBeatmap
 }
@@ -28,6 +70,8 @@ func New(cgdataPath string) *House {
 	return &House{
 		MaxSize:     1024 * 1024 * 1024 * 10, // 10 gigs
 		FilePath:    cgdataPath,
+		Storage:     LocalStorage("data"),
+		Policy:      LRU{},
 		requestChan: make(chan struct{}, 1),
 	}
 }
@@ -55,88 +99,98 @@ func (h *House) StartCleaner() {
 }
 
 func (h *House) cleanUp() {
-	log.Println("[C] Running cleanup")
+	h.logger().Debug("running cleanup")
 
-	toRemove := h.mapsToRemove()
-
-	f, err := os.Create(h.FilePath)
-	if err != nil {
-		logError(err)
-		return
+	if err := h.evict(h.mapsToRemove()); err != nil {
+		h.logError("cleanup failed", err)
 	}
+}
 
-	// build new state by removing from it the beatmaps from toRemove
-	h.stateMutex.Lock()
-	newState := make([]*CachedBeatmap, 0, len(h.state))
-StateLoop:
-	for _, b := range h.state {
-		for _, r := range toRemove {
-			if r.ID == b.ID && r.NoVideo == b.NoVideo {
-				continue StateLoop
-			}
-		}
-		newState = append(newState, b)
+// evict removes the beatmaps from the state, saves it, and then removes their
+// files from the storage.
+func (h *House) evict(toRemove []*CachedBeatmap) error {
+	h.remove(toRemove)
+
+	if err := h.SaveState(); err != nil {
+		return err
 	}
-	h.state = newState
-	err = writeBeatmaps(f, h.state)
-	h.stateMutex.Unlock()
 
-	f.Close()
-	if err != nil {
-		logError(err)
-		return
+	for _, b := range toRemove {
+		h.Policy.Evicted(b)
+		evictions.Inc()
+		evictedBytes.Add(float64(b.FileSize()))
 	}
 
 	if h.dryRun != nil {
 		h.dryRun = toRemove
-		return
+		return nil
 	}
 
 	for _, b := range toRemove {
-		err := os.Remove(b.fileName())
+		err := h.Storage.Remove(b.fileName())
 		switch {
-		case err == nil, os.IsNotExist(err):
+		case err == nil, errors.Is(err, fs.ErrNotExist):
 			// silently ignore
 		default:
-			logError(err)
+			h.logError("can't remove evicted beatmap", err, "set_id", b.ID, "no_video", b.NoVideo)
 		}
 	}
+	return nil
+}
+
+// Evict removes a set from the cache, both with and without video, even if it
+// is pinned, and returns the beatmaps which were removed. Beatmaps which are
+// still being downloaded are left alone.
+func (h *House) Evict(setID int) ([]*CachedBeatmap, error) {
+	var toRemove []*CachedBeatmap
+	for _, noVideo := range []bool{false, true} {
+		if b := h.Lookup(setID, noVideo); b != nil && b.IsDownloaded() {
+			toRemove = append(toRemove, b)
+		}
+	}
+	if len(toRemove) == 0 {
+		return nil, nil
+	}
+	h.logger().Info("evicting set", "set_id", setID)
+	return toRemove, h.evict(toRemove)
 }
 
 func (h *House) mapsToRemove() []*CachedBeatmap {
 	badBeatmaps := h.badBeatmaps()
 	if len(badBeatmaps) > 0 {
-		log.Println("[C] Bad Beatmaps", len(badBeatmaps))
+		h.logger().Info("removing bad beatmaps", "count", len(badBeatmaps))
 		return badBeatmaps
 	}
 
 	totalSize, removable := h.stateSizeAndRemovableMaps()
 
+	// first of all, every ranked status must fit in its quota.
+	toRemove, freed := h.quotaMapsToRemove(removable)
+	if len(toRemove) > 0 {
+		h.logger().Info("removing beatmaps over quota", "count", len(toRemove))
+		totalSize -= freed
+		removable = without(removable, toRemove)
+	}
+
 	if totalSize <= h.MaxSize {
 		// no clean up needed, our totalSize has still not gotten over the
 		// threshold
-		return nil
+		return toRemove
 	}
 
-	sortByLastRequested(removable)
-
+	q := newEvictionQueue(h.Policy, removable)
 	removeBytes := int(totalSize - h.MaxSize)
-	var toRemove []*CachedBeatmap
-	for _, b := range removable {
-		toRemove = append(toRemove, b)
-		fSize := b.FileSize()
-		removeBytes -= int(fSize)
-		if removeBytes <= 0 {
-			break
-		}
+	for removeBytes > 0 && q.Len() > 0 {
+		e := q.next()
+		toRemove = append(toRemove, e.b)
+		removeBytes -= int(e.fileSize)
 	}
 
 	return toRemove
 }
 
 func (h *House) badBeatmaps() (removable []*CachedBeatmap) {
-	h.stateMutex.RLock()
-	for _, b := range h.state {
+	for _, b := range h.beatmaps() {
 		if !b.IsDownloaded() {
 			continue
 		}
@@ -145,41 +199,118 @@ func (h *House) badBeatmaps() (removable []*CachedBeatmap) {
 			removable = append(removable, b)
 		}
 	}
-	h.stateMutex.RUnlock()
 	return
 }
 
 // i hate verbose names myself, but it was very hard to come up with something
 // even as short as this.
 func (h *House) stateSizeAndRemovableMaps() (totalSize uint64, removable []*CachedBeatmap) {
-	h.stateMutex.RLock()
-	for _, b := range h.state {
+	h.pinsMutex.RLock()
+	defer h.pinsMutex.RUnlock()
+	for _, b := range h.beatmaps() {
 		if !b.IsDownloaded() {
 			continue
 		}
 		fSize := b.FileSize()
 		totalSize += fSize
-		if fSize == 0 {
+		if fSize == 0 || h.pins[b.ID] || h.StaticPins[b.ID] {
 			continue
 		}
 		removable = append(removable, b)
 	}
-	h.stateMutex.RUnlock()
 	return
 }
 
-func sortByLastRequested(b []*CachedBeatmap) {
-	sort.Slice(b, func(i, j int) bool {
-		b[i].mtx.RLock()
-		b[j].mtx.RLock()
-		r := b[i].lastRequested.Before(b[j].lastRequested)
-		b[i].mtx.RUnlock()
-		b[j].mtx.RUnlock()
-		return r
-	})
+// Size returns the number of bytes used by the beatmaps in the cache.
+func (h *House) Size() (size uint64) {
+	for _, b := range h.beatmaps() {
+		if b.IsDownloaded() {
+			size += b.FileSize()
+		}
+	}
+	return
+}
+
+// quotaMapsToRemove returns the beatmaps to remove so that the beatmaps of
+// every ranked status fit in its quota, and the number of bytes this frees.
+// Pinned beatmaps count towards the quotas, but are never removed.
+func (h *House) quotaMapsToRemove(removable []*CachedBeatmap) (toRemove []*CachedBeatmap, freed uint64) {
+	if len(h.Quotas) == 0 {
+		return nil, 0
+	}
+
+	used := make(map[int]uint64)
+	for _, b := range h.beatmaps() {
+		if b.IsDownloaded() {
+			used[b.status()] += b.FileSize()
+		}
+	}
+
+	byStatus := make(map[int][]*CachedBeatmap)
+	for _, b := range removable {
+		s := b.status()
+		byStatus[s] = append(byStatus[s], b)
+	}
+
+	statuses := make([]int, 0, len(h.Quotas))
+	for s := range h.Quotas {
+		statuses = append(statuses, s)
+	}
+	sort.Ints(statuses)
+
+	for _, s := range statuses {
+		quota := h.Quotas[s]
+		q := newEvictionQueue(h.Policy, byStatus[s])
+		for used[s] > quota && q.Len() > 0 {
+			e := q.next()
+			toRemove = append(toRemove, e.b)
+			used[s] -= e.fileSize
+			freed += e.fileSize
+		}
+	}
+	return
+}
+
+// without returns the beatmaps in bms which are not in remove.
+func without(bms, remove []*CachedBeatmap) []*CachedBeatmap {
+	rm := make(map[*CachedBeatmap]bool, len(remove))
+	for _, b := range remove {
+		rm[b] = true
+	}
+	res := make([]*CachedBeatmap, 0, len(bms))
+	for _, b := range bms {
+		if !rm[b] {
+			res = append(res, b)
+		}
+	}
+	return res
 }
 
-// LoadState attempts to load the state from cgbin.db
+// SaveState writes the state to cgbin.db. The file is replaced atomically, so
+// that a crash while writing it never loses the previous state. The state is
+// saved by every cleanup, but it should also be saved before exiting, so that
+// the latest requests of the beatmaps are not lost.
+func (h *House) SaveState() error {
+	h.fileMutex.Lock()
+	defer h.fileMutex.Unlock()
+
+	buf := &bytes.Buffer{}
+	err := writeBeatmaps(buf, h.beatmaps())
+	if err == nil {
+		h.pinsMutex.RLock()
+		pins := h.sortedPins()
+		h.pinsMutex.RUnlock()
+		err = writePins(buf, pins)
+	}
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(h.FilePath, buf.Bytes())
+}
+
+// LoadState attempts to load the state from cgbin.db. If some of the records
+// in the file are corrupt, a *CorruptStateError is returned, but the beatmaps
+// which could be read are loaded nonetheless.
 func (h *House) LoadState() error {
 	f, err := os.Open(h.FilePath)
 	switch {
@@ -190,9 +321,26 @@ func (h *House) LoadState() error {
 	}
 	defer f.Close()
 
-	h.stateMutex.Lock()
-	h.state, err = readBeatmaps(f)
-	h.stateMutex.Unlock()
+	r := bufio.NewReader(f)
+	state, err := readBeatmaps(r)
+	for _, b := range state {
+		b.storage = h.Storage
+	}
+	h.setState(state)
+
+	var corruptErr *CorruptStateError
+	if err != nil && !errors.As(err, &corruptErr) {
+		return err
+	}
+	// losing the pins is not a good reason not to start.
+	pins, pinsErr := readPins(r)
+	h.logError("can't read pins", pinsErr)
+	h.pinsMutex.Lock()
+	h.pins = make(map[int]bool, len(pins))
+	for _, id := range pins {
+		h.pins[id] = true
+	}
+	h.pinsMutex.Unlock()
 
 	return err
 }
@@ -202,46 +350,37 @@ const zipMagic = "PK\x03\x04"
 // RemoveNonZip reads all the beatmaps currently in the house to ensure that
 // they are all zip files. Those which are not get removed.
 func (h *House) RemoveNonZip() {
-	f, err := os.Create(h.FilePath)
-	if err != nil {
-		logError(err)
-		return
-	}
-
-	h.stateMutex.Lock()
-	state2 := make([]*CachedBeatmap, 0, len(h.state))
-	log.Println("[F] Removing non-zip files...", len(h.state), "beatmaps to read")
-	for _, beatmap := range h.state {
+	state := h.beatmaps()
+	var toRemove []*CachedBeatmap
+	h.logger().Info("removing non-zip files", "beatmaps", len(state))
+	for _, beatmap := range state {
+		l := h.logger().With("set_id", beatmap.ID, "no_video", beatmap.NoVideo)
 		remove, err := checkBeatmap(beatmap)
 		if err != nil {
-			log.Println("[F] Error:", err)
+			l.Error("can't check beatmap", "err", err)
+			toRemove = append(toRemove, beatmap)
 			continue
 		}
 		if remove {
-			err = os.Remove(beatmap.fileName())
+			toRemove = append(toRemove, beatmap)
+			err = h.Storage.Remove(beatmap.fileName())
 			if err != nil {
-				log.Println("[F] Error removing:", err)
+				l.Error("can't remove beatmap", "err", err)
 			} else {
-				log.Println("[F] Remove:", beatmap.ID, beatmap.NoVideo)
+				l.Info("removed non-zip beatmap")
 			}
-		} else {
-			state2 = append(state2, beatmap)
 		}
 	}
-	err = writeBeatmaps(f, state2)
-	if err != nil {
-		logError(err)
+	h.remove(toRemove)
+	if err := h.SaveState(); err != nil {
+		h.logError("can't save state", err)
 	}
-	h.state = state2
-	h.stateMutex.Unlock()
-	f.Close()
-	log.Println("[F] CleanUp")
 	h.cleanUp()
 }
 
 func checkBeatmap(b *CachedBeatmap) (bool, error) {
-	f, err := b.File()
-	if os.IsNotExist(err) {
+	f, err := b.File(context.Background())
+	if errors.Is(err, fs.ErrNotExist) {
 		return true, nil
 	}
 	if err != nil {
@@ -256,13 +395,20 @@ func checkBeatmap(b *CachedBeatmap) (bool, error) {
 
 var envSentryDSN = os.Getenv("SENTRY_DSN")
 
-// logError attempts to log an error to Sentry, as well as stdout.
-func logError(err error) {
+func (h *House) logger() *slog.Logger {
+	if h.Logger != nil {
+		return h.Logger
+	}
+	return slog.Default()
+}
+
+// logError attempts to log an error to Sentry, as well as to the logger.
+func (h *House) logError(msg string, err error, args ...any) {
 	if err == nil {
 		return
 	}
 	if envSentryDSN != "" {
 		raven.CaptureError(err, nil)
 	}
-	log.Println(err)
+	h.logger().Error(msg, append(args, "err", err)...)
 }
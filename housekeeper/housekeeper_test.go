@@ -1,6 +1,7 @@
 package housekeeper
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"testing"
@@ -61,14 +62,14 @@ func TestCleanup(t *testing.T) {
 
 	h := New(f.path)
 	h.MaxSize = 50000
-	h.state = append(expectRemain, expectRemove...)
+	h.setState(append(expectRemain, expectRemove...))
 	h.dryRun = make([]*CachedBeatmap, 0)
 
 	start := time.Now()
 	h.cleanUp()
 	t.Log("cleanup took", time.Since(start))
 
-	require.Equal(t, expectRemain, h.state)
+	require.Equal(t, expectRemain, h.Beatmaps())
 	require.Equal(t, expectRemove, h.dryRun)
 }
 
@@ -88,14 +89,14 @@ func TestCleanupNoMaps(t *testing.T) {
 
 	h := New(f.path)
 	h.MaxSize = 100000
-	h.state = append(expectRemain, expectRemove...)
+	h.setState(append(expectRemain, expectRemove...))
 	h.dryRun = make([]*CachedBeatmap, 0)
 
 	start := time.Now()
 	h.cleanUp()
 	t.Log("cleanup took", time.Since(start))
 
-	require.Equal(t, expectRemain, h.state)
+	require.Equal(t, expectRemain, h.Beatmaps())
 	require.Empty(t, h.dryRun)
 }
 
@@ -134,13 +135,124 @@ func TestCleanupEmptyBeatmaps(t *testing.T) {
 
 	h := New(f.path)
 	h.MaxSize = 5
-	h.state = append(expectRemain, expectRemove...)
+	h.setState(append(expectRemain, expectRemove...))
 	h.dryRun = make([]*CachedBeatmap, 0)
 
 	start := time.Now()
 	h.cleanUp()
 	t.Log("cleanup took", time.Since(start))
 
-	require.Equal(t, expectRemain, h.state)
+	require.Equal(t, expectRemain, h.Beatmaps())
 	require.Equal(t, expectRemove, h.dryRun)
 }
+
+func TestLookup(t *testing.T) {
+	h := New(newTestFolder(t).path)
+	bms := []*CachedBeatmap{
+		{ID: 1, isDownloaded: true},
+		{ID: 1, NoVideo: true, isDownloaded: true},
+	}
+	h.setState(bms)
+
+	require.Same(t, bms[0], h.Lookup(1, false))
+	require.Same(t, bms[1], h.Lookup(1, true))
+	require.Nil(t, h.Lookup(2, false))
+	// Lookup must never add beatmaps to the state
+	require.Len(t, h.Beatmaps(), 2)
+}
+
+func TestWaitDownloaded(t *testing.T) {
+	h := New(newTestFolder(t).path)
+	b, _ := h.AcquireBeatmap(&CachedBeatmap{ID: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, b.WaitDownloaded(ctx))
+
+	go b.DownloadCompleted(0, h)
+	require.NoError(t, b.WaitDownloaded(context.Background()))
+	require.True(t, b.IsDownloaded())
+}
+
+func TestAcquireBeatmapKeepsStatus(t *testing.T) {
+	h := New(newTestFolder(t).path)
+	b, added := h.AcquireBeatmap(&CachedBeatmap{ID: 1, RankedStatus: 1})
+	require.True(t, added)
+	// the status is only set through SetRankedStatus.
+	require.Equal(t, UnknownStatus, b.status())
+	b.SetRankedStatus(1)
+
+	// acquiring it again without a status, or setting an unknown one, must
+	// not mark it as pending.
+	b2, _ := h.AcquireBeatmap(&CachedBeatmap{ID: 1})
+	require.Same(t, b, b2)
+	b2.SetRankedStatus(UnknownStatus)
+	require.Equal(t, 1, b.status())
+}
+
+func TestCleanupPinsAndQuotas(t *testing.T) {
+	const (
+		graveyard = -2
+		ranked    = 1
+	)
+	bms := []*CachedBeatmap{
+		// the least recently requested, but pinned.
+		{ID: 1, RankedStatus: ranked, fileSize: 20000, isDownloaded: true,
+			lastRequested: time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{ID: 2, RankedStatus: graveyard, fileSize: 20000, isDownloaded: true,
+			lastRequested: time.Date(2017, 4, 2, 0, 0, 0, 0, time.UTC)},
+		{ID: 3, RankedStatus: graveyard, fileSize: 20000, isDownloaded: true,
+			lastRequested: time.Date(2017, 4, 3, 0, 0, 0, 0, time.UTC)},
+		{ID: 4, RankedStatus: ranked, fileSize: 20000, isDownloaded: true,
+			lastRequested: time.Date(2017, 4, 4, 0, 0, 0, 0, time.UTC)},
+		// pinned beatmaps count towards the quota of their status.
+		{ID: 5, RankedStatus: graveyard, fileSize: 20000, isDownloaded: true,
+			lastRequested: time.Date(2017, 4, 5, 0, 0, 0, 0, time.UTC)},
+	}
+
+	h := New(newTestFolder(t).path)
+	h.MaxSize = 100000
+	h.Quotas = map[int]uint64{graveyard: 30000}
+	h.setState(bms)
+	h.dryRun = make([]*CachedBeatmap, 0)
+	h.StaticPins = map[int]bool{5: true}
+	require.NoError(t, h.Pin(1))
+
+	// the cache is not full, but there are too many graveyard beatmaps.
+	h.cleanUp()
+	require.Equal(t, []*CachedBeatmap{bms[1], bms[2]}, h.dryRun)
+
+	// the cache is full: the pinned beatmap is skipped.
+	h.Quotas = nil
+	h.MaxSize = 50000
+	h.dryRun = make([]*CachedBeatmap, 0)
+	h.cleanUp()
+	require.Equal(t, []*CachedBeatmap{bms[3]}, h.dryRun)
+	require.Equal(t, []*CachedBeatmap{bms[0], bms[4]}, h.Beatmaps())
+	require.Equal(t, []int{1, 5}, h.Pins())
+}
+
+func TestEvict(t *testing.T) {
+	bms := []*CachedBeatmap{
+		{ID: 1, fileSize: 20000, isDownloaded: true},
+		{ID: 1, NoVideo: true, fileSize: 15000, isDownloaded: true},
+		{ID: 2, fileSize: 20000, isDownloaded: true},
+		// still being downloaded.
+		{ID: 3},
+	}
+
+	h := New(newTestFolder(t).path)
+	h.setState(bms)
+	h.dryRun = make([]*CachedBeatmap, 0)
+	require.NoError(t, h.Pin(1))
+
+	removed, err := h.Evict(1)
+	require.NoError(t, err)
+	require.Equal(t, bms[:2], removed)
+	require.Equal(t, bms[:2], h.dryRun)
+
+	removed, err = h.Evict(3)
+	require.NoError(t, err)
+	require.Empty(t, removed)
+	require.Equal(t, []*CachedBeatmap{bms[2], bms[3]}, h.Beatmaps())
+}
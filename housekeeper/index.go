@@ -0,0 +1,109 @@
+package housekeeper
+
+import (
+	"sort"
+	"sync"
+)
+
+// stateShards is the number of shards in which the state is split. Every
+// shard has its own lock, so that requests for different beatmaps rarely
+// contend with each other.
+const stateShards = 64
+
+// stateShard is a part of the state, indexed by ID and NoVideo.
+type stateShard struct {
+	mtx sync.RWMutex
+	m   map[beatmapKey]*CachedBeatmap
+}
+
+func (h *House) shard(k beatmapKey) *stateShard {
+	return &h.state[uint(k.ID)%stateShards]
+}
+
+// get returns the beatmap with the given key, or nil if there is none.
+func (h *House) get(k beatmapKey) *CachedBeatmap {
+	s := h.shard(k)
+	s.mtx.RLock()
+	b := s.m[k]
+	s.mtx.RUnlock()
+	return b
+}
+
+// getOrAdd returns the beatmap with the given key. If there is none, the one
+// returned by create is added to the state and returned, alongside true.
+func (h *House) getOrAdd(k beatmapKey, create func() *CachedBeatmap) (*CachedBeatmap, bool) {
+	s := h.shard(k)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if b, ok := s.m[k]; ok {
+		return b, false
+	}
+	if s.m == nil {
+		s.m = make(map[beatmapKey]*CachedBeatmap)
+	}
+	b := create()
+	s.m[k] = b
+	return b, true
+}
+
+// remove removes the given beatmaps from the state. Beatmaps which have been
+// replaced in the state by a different CachedBeatmap with the same key are
+// left alone.
+func (h *House) remove(bms []*CachedBeatmap) {
+	for _, b := range bms {
+		k := b.key()
+		s := h.shard(k)
+		s.mtx.Lock()
+		if s.m[k] == b {
+			delete(s.m, k)
+		}
+		s.mtx.Unlock()
+	}
+}
+
+// beatmaps returns all the beatmaps in the state, in no particular order.
+func (h *House) beatmaps() []*CachedBeatmap {
+	var res []*CachedBeatmap
+	for i := range h.state {
+		s := &h.state[i]
+		s.mtx.RLock()
+		for _, b := range s.m {
+			res = append(res, b)
+		}
+		s.mtx.RUnlock()
+	}
+	return res
+}
+
+// Beatmaps returns all the beatmaps in the state, sorted by ID. Beatmaps
+// without video come after the ones with the same ID with video.
+func (h *House) Beatmaps() []*CachedBeatmap {
+	res := h.beatmaps()
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].ID != res[j].ID {
+			return res[i].ID < res[j].ID
+		}
+		return !res[i].NoVideo && res[j].NoVideo
+	})
+	return res
+}
+
+// setState replaces the whole state with bms.
+func (h *House) setState(bms []*CachedBeatmap) {
+	for i := range h.state {
+		s := &h.state[i]
+		s.mtx.Lock()
+		s.m = nil
+		s.mtx.Unlock()
+	}
+	for _, b := range bms {
+		k := b.key()
+		s := h.shard(k)
+		s.mtx.Lock()
+		if s.m == nil {
+			s.m = make(map[beatmapKey]*CachedBeatmap)
+		}
+		s.m[k] = b
+		s.mtx.Unlock()
+	}
+}
@@ -0,0 +1,120 @@
+package housekeeper
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoveReplaced(t *testing.T) {
+	h := New(newTestFolder(t).path)
+	old := &CachedBeatmap{ID: 1, isDownloaded: true}
+	h.setState([]*CachedBeatmap{old})
+
+	// the beatmap is evicted and downloaded again before the cleanup removes
+	// it from the state: the new one must stay.
+	h.remove([]*CachedBeatmap{old})
+	b, added := h.AcquireBeatmap(&CachedBeatmap{ID: 1})
+	require.True(t, added)
+	h.remove([]*CachedBeatmap{old})
+	require.Same(t, b, h.Lookup(1, false))
+}
+
+func TestAcquireBeatmapConcurrent(t *testing.T) {
+	h := New(newTestFolder(t).path)
+	var (
+		wg    sync.WaitGroup
+		added int32
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := h.AcquireBeatmap(&CachedBeatmap{ID: 1}); ok {
+				atomic.AddInt32(&added, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	// only one of the callers must download the beatmap.
+	require.Equal(t, int32(1), added)
+	require.Len(t, h.Beatmaps(), 1)
+}
+
+const benchStateSize = 100000
+
+func benchBeatmaps() []*CachedBeatmap {
+	base := time.Date(2017, 4, 5, 15, 5, 3, 0, time.UTC)
+	bms := make([]*CachedBeatmap, benchStateSize)
+	for i := range bms {
+		bms[i] = &CachedBeatmap{
+			ID:            i + 1,
+			LastUpdate:    base,
+			lastRequested: base.Add(time.Duration(rand.Intn(1000000)) * time.Second),
+			requests:      uint64(rand.Intn(100)),
+			fileSize:      uint64(10000 + rand.Intn(50000000)),
+			isDownloaded:  true,
+		}
+	}
+	return bms
+}
+
+func BenchmarkAcquireBeatmap(b *testing.B) {
+	h := New("")
+	h.setState(benchBeatmaps())
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for pb.Next() {
+			h.AcquireBeatmap(&CachedBeatmap{
+				ID: r.Intn(benchStateSize) + 1,
+			})
+		}
+	})
+}
+
+// BenchmarkAcquireBeatmapLinear measures the linear scan under a global lock
+// which AcquireBeatmap used to do, for comparison.
+func BenchmarkAcquireBeatmapLinear(b *testing.B) {
+	var mtx sync.Mutex
+	state := benchBeatmaps()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for pb.Next() {
+			id := r.Intn(benchStateSize) + 1
+			mtx.Lock()
+			for _, bm := range state {
+				if bm.ID == id && !bm.NoVideo {
+					break
+				}
+			}
+			mtx.Unlock()
+		}
+	})
+}
+
+func BenchmarkMapsToRemove(b *testing.B) {
+	for _, name := range []string{"lru", "lfu", "gdsf"} {
+		b.Run(name, func(b *testing.B) {
+			h := New("")
+			h.Policy, _ = NewPolicy(name)
+			bms := benchBeatmaps()
+			h.setState(bms)
+			// require evicting about 1% of the cache.
+			var total uint64
+			for _, bm := range bms {
+				total += bm.fileSize
+			}
+			h.MaxSize = total - total/100
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.mapsToRemove()
+			}
+		})
+	}
+}
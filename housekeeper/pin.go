@@ -0,0 +1,57 @@
+package housekeeper
+
+import "sort"
+
+// Pin pins a set, so that it is never evicted from the cache, whether it is
+// cached with or without video. Sets may be pinned before being cached. Pins
+// are saved in the state file.
+func (h *House) Pin(setID int) error {
+	h.pinsMutex.Lock()
+	if h.pins == nil {
+		h.pins = make(map[int]bool)
+	}
+	h.pins[setID] = true
+	h.pinsMutex.Unlock()
+	return h.SaveState()
+}
+
+// Unpin removes the pin of a set, so that it can be evicted again.
+func (h *House) Unpin(setID int) error {
+	h.pinsMutex.Lock()
+	delete(h.pins, setID)
+	h.pinsMutex.Unlock()
+	return h.SaveState()
+}
+
+// Pinned checks whether a set is pinned, either with Pin or by StaticPins.
+func (h *House) Pinned(setID int) bool {
+	h.pinsMutex.RLock()
+	defer h.pinsMutex.RUnlock()
+	return h.pins[setID] || h.StaticPins[setID]
+}
+
+// Pins returns the IDs of the pinned sets, including StaticPins, in ascending
+// order.
+func (h *House) Pins() []int {
+	h.pinsMutex.RLock()
+	defer h.pinsMutex.RUnlock()
+	pins := h.sortedPins()
+	for id := range h.StaticPins {
+		if !h.pins[id] {
+			pins = append(pins, id)
+		}
+	}
+	sort.Ints(pins)
+	return pins
+}
+
+// sortedPins returns the sets pinned with Pin. It must be called with
+// h.pinsMutex held.
+func (h *House) sortedPins() []int {
+	pins := make([]int, 0, len(h.pins))
+	for id := range h.pins {
+		pins = append(pins, id)
+	}
+	sort.Ints(pins)
+	return pins
+}
@@ -0,0 +1,195 @@
+package housekeeper
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Policy decides which beatmaps are evicted first when the cache grows over
+// its maximum size.
+type Policy interface {
+	// Requested is called every time a beatmap is requested, after its
+	// request count and time have been updated.
+	Requested(b *CachedBeatmap)
+	// Evicted is called when a beatmap is removed from the cache.
+	Evicted(b *CachedBeatmap)
+	// Priority returns the priority of a beatmap in the cache. Beatmaps with
+	// the lowest priority are evicted first; beatmaps with the same priority
+	// are evicted in LRU order.
+	Priority(u BeatmapUsage) float64
+}
+
+// BeatmapUsage describes how a beatmap in the cache has been used, and which
+// version of the set it is.
+type BeatmapUsage struct {
+	ID            int
+	NoVideo       bool
+	LastUpdate    time.Time
+	RankedStatus  int
+	LastRequested time.Time
+	Requests      uint64
+	FileSize      uint64
+}
+
+// Usage returns the usage of the beatmap.
+func (c *CachedBeatmap) Usage() BeatmapUsage {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return BeatmapUsage{
+		ID:            c.ID,
+		NoVideo:       c.NoVideo,
+		LastUpdate:    c.LastUpdate,
+		RankedStatus:  c.RankedStatus,
+		LastRequested: c.lastRequested,
+		Requests:      c.requests,
+		FileSize:      c.fileSize,
+	}
+}
+
+// NewPolicy creates the Policy with the given name: lru, lfu or gdsf.
+func NewPolicy(name string) (Policy, error) {
+	switch name {
+	case "lru":
+		return LRU{}, nil
+	case "lfu":
+		return LFU{}, nil
+	case "gdsf":
+		return NewGDSF(), nil
+	}
+	return nil, fmt.Errorf("cheesegull/housekeeper: unknown eviction policy %q", name)
+}
+
+// beatmapKey identifies a beatmap in the cache.
+type beatmapKey struct {
+	ID      int
+	NoVideo bool
+}
+
+func (c *CachedBeatmap) key() beatmapKey {
+	return beatmapKey{c.ID, c.NoVideo}
+}
+
+// evictionQueue is a heap of beatmaps ordered by the priority given to them by
+// a Policy, so that the first beatmaps to evict can be found without sorting
+// all of them.
+type evictionQueue []evictionEntry
+
+type evictionEntry struct {
+	b             *CachedBeatmap
+	priority      float64
+	lastRequested int64
+	fileSize      uint64
+}
+
+func newEvictionQueue(p Policy, bms []*CachedBeatmap) *evictionQueue {
+	q := make(evictionQueue, len(bms))
+	for i, b := range bms {
+		u := b.Usage()
+		q[i] = evictionEntry{b, p.Priority(u), u.LastRequested.UnixNano(), u.FileSize}
+	}
+	heap.Init(&q)
+	return &q
+}
+
+func (q evictionQueue) Len() int { return len(q) }
+func (q evictionQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority < q[j].priority
+	}
+	return q[i].lastRequested < q[j].lastRequested
+}
+func (q evictionQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *evictionQueue) Push(x interface{}) { *q = append(*q, x.(evictionEntry)) }
+func (q *evictionQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// next removes the beatmap to evict first from the queue.
+func (q *evictionQueue) next() evictionEntry {
+	return heap.Pop(q).(evictionEntry)
+}
+
+// LRU evicts the least recently requested beatmaps first.
+type LRU struct{}
+
+// Requested does nothing: the time of the last request is kept in the
+// CachedBeatmap.
+func (LRU) Requested(*CachedBeatmap) {}
+
+// Evicted does nothing.
+func (LRU) Evicted(*CachedBeatmap) {}
+
+// Priority is the same for all beatmaps, so that they are evicted in LRU
+// order.
+func (LRU) Priority(BeatmapUsage) float64 { return 0 }
+
+// LFU evicts the least frequently requested beatmaps first. Beatmaps requested
+// the same number of times are evicted in LRU order.
+type LFU struct{}
+
+// Requested does nothing: the number of requests is kept in the
+// CachedBeatmap.
+func (LFU) Requested(*CachedBeatmap) {}
+
+// Evicted does nothing.
+func (LFU) Evicted(*CachedBeatmap) {}
+
+// Priority is the number of requests of the beatmap.
+func (LFU) Priority(u BeatmapUsage) float64 { return float64(u.Requests) }
+
+// GDSF is the Greedy-Dual-Size-Frequency policy. Every beatmap has a priority
+// of L + requests/size, where L is the priority of the last evicted beatmap at
+// the time of the last request to the beatmap, and the beatmaps with the lowest
+// priority are evicted first. This way, small beatmaps are preferred to large
+// ones, unless the large ones are requested much more often, and beatmaps
+// which were popular a long time ago eventually age out.
+//
+// L is not persisted: after a restart, all beatmaps start again from the same
+// L.
+type GDSF struct {
+	mtx       sync.Mutex
+	inflation float64
+	// lastL is the value of L at the time of the last request of every
+	// beatmap.
+	lastL map[beatmapKey]float64
+}
+
+// NewGDSF creates a new GDSF policy.
+func NewGDSF() *GDSF {
+	return &GDSF{lastL: make(map[beatmapKey]float64)}
+}
+
+// Requested records the current value of L for the beatmap.
+func (g *GDSF) Requested(b *CachedBeatmap) {
+	g.mtx.Lock()
+	g.lastL[b.key()] = g.inflation
+	g.mtx.Unlock()
+}
+
+// Evicted raises L to the priority of the evicted beatmap.
+func (g *GDSF) Evicted(b *CachedBeatmap) {
+	p := g.Priority(b.Usage())
+	g.mtx.Lock()
+	if p > g.inflation {
+		g.inflation = p
+	}
+	delete(g.lastL, b.key())
+	g.mtx.Unlock()
+}
+
+// Priority returns L + requests/size.
+func (g *GDSF) Priority(u BeatmapUsage) float64 {
+	g.mtx.Lock()
+	l := g.lastL[beatmapKey{u.ID, u.NoVideo}]
+	g.mtx.Unlock()
+	size := float64(u.FileSize)
+	if size < 1 {
+		size = 1
+	}
+	return l + float64(u.Requests)/size
+}
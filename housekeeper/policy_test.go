@@ -0,0 +1,87 @@
+package housekeeper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testPolicyBeatmaps() []*CachedBeatmap {
+	base := time.Date(2017, 4, 5, 15, 5, 3, 0, time.UTC)
+	return []*CachedBeatmap{
+		// a popular large set, last requested a while ago
+		{ID: 1, fileSize: 50000000, requests: 500, lastRequested: base},
+		// small sets downloaded only once, more recently
+		{ID: 2, fileSize: 5000000, requests: 1, lastRequested: base.Add(time.Hour)},
+		{ID: 3, fileSize: 2000000, requests: 1, lastRequested: base.Add(time.Hour * 2)},
+		// a large set downloaded once
+		{ID: 4, fileSize: 80000000, requests: 1, lastRequested: base.Add(time.Hour * 3)},
+	}
+}
+
+func evictionOrder(p Policy, bms []*CachedBeatmap) []int {
+	q := newEvictionQueue(p, bms)
+	var ids []int
+	for q.Len() > 0 {
+		ids = append(ids, q.next().b.ID)
+	}
+	return ids
+}
+
+func TestPolicies(t *testing.T) {
+	tt := []struct {
+		name  string
+		order []int
+	}{
+		{"lru", []int{1, 2, 3, 4}},
+		{"lfu", []int{2, 3, 4, 1}},
+		{"gdsf", []int{4, 2, 3, 1}},
+	}
+	for _, tc := range tt {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := NewPolicy(tc.name)
+			require.NoError(t, err)
+			require.Equal(t, tc.order, evictionOrder(p, testPolicyBeatmaps()))
+		})
+	}
+
+	_, err := NewPolicy("fifo")
+	require.Error(t, err)
+}
+
+func TestGDSFAging(t *testing.T) {
+	g := NewGDSF()
+	h := New(newTestFolder(t).path)
+	h.Policy = g
+
+	bms := testPolicyBeatmaps()
+	// evicting the popular set raises L over the priority of all the other
+	// sets, so the ones requested after that are now worth more.
+	g.Evicted(bms[0])
+	h.Requested(bms[1])
+	require.Equal(t, uint64(2), bms[1].Requests())
+	require.Equal(t, []int{4, 3, 2}, evictionOrder(g, bms[1:]))
+}
+
+func TestCleanupPolicy(t *testing.T) {
+	f := newTestFolder(t)
+	h := New(f.path)
+	h.Policy = LFU{}
+	h.MaxSize = 60000000
+	bms := testPolicyBeatmaps()
+	for _, b := range bms {
+		b.isDownloaded = true
+	}
+	h.setState(bms)
+	h.dryRun = make([]*CachedBeatmap, 0)
+
+	h.cleanUp()
+
+	// with LFU, the popular set survives even though it's the least recently
+	// requested.
+	require.Len(t, h.dryRun, 3)
+	require.Len(t, h.Beatmaps(), 1)
+	require.Equal(t, 1, h.Beatmaps()[0].ID)
+}
@@ -0,0 +1,214 @@
+package housekeeper
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// ReconcileReport describes the differences between the state and the storage
+// found by Reconcile, and how they were resolved.
+type ReconcileReport struct {
+	// Adopted are the files which were in the storage but not in the state,
+	// and have been added to it.
+	Adopted []string
+	// Dropped are the files which were in the state but not in the storage,
+	// and have been removed from it.
+	Dropped []string
+	// Resized are the files whose size in the state did not match the one
+	// in the storage, and has been corrected.
+	Resized []string
+	// Broken are the files which were in the storage but not in the state,
+	// and are not readable archives, like the ones whose writing was
+	// interrupted, as well as the temporary files left behind by the
+	// downloads which were interrupted. They have been removed.
+	Broken []string
+	// Ignored are the files in the storage which are not beatmaps.
+	Ignored []string
+}
+
+func (r ReconcileReport) String() string {
+	return fmt.Sprintf("%d adopted, %d dropped, %d resized, %d broken, %d ignored",
+		len(r.Adopted), len(r.Dropped), len(r.Resized), len(r.Broken), len(r.Ignored))
+}
+
+var beatmapFileName = regexp.MustCompile(`^([0-9]+)(n?)\.osz$`)
+
+// tempFileName matches the names of the temporary files LocalStorage writes
+// the beatmaps to before renaming them.
+var tempFileName = regexp.MustCompile(`^\.([0-9]+n?\.osz)\.[0-9]+\.tmp$`)
+
+// parseFileName is the inverse of CachedBeatmap.fileName.
+func parseFileName(name string) (id int, noVideo, ok bool) {
+	m := beatmapFileName.FindStringSubmatch(name)
+	if m == nil {
+		return 0, false, false
+	}
+	id, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, false, false
+	}
+	return id, m[2] == "n", true
+}
+
+// readableArchive checks whether a file in the storage is a zip archive whose
+// central directory can be read, which is not the case for truncated ones.
+func readableArchive(s Storage, fi fs.FileInfo) bool {
+	f, err := s.Open(context.Background(), fi.Name())
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = zip.NewReader(f, fi.Size())
+	return err == nil
+}
+
+// Reconcile compares the state with the files which are actually in the
+// storage. Files which are not in the state are adopted if they are readable
+// archives, and removed otherwise, like the temporary files of the downloads
+// which were interrupted. As a file is written after the last update of its
+// set, its modification time is used as the version of an adopted beatmap:
+// it is downloaded again only if the set has been updated since. Beatmaps
+// whose file has gone missing are dropped from the state. Beatmaps which are
+// still being downloaded are left alone.
+func (h *House) Reconcile() (ReconcileReport, error) {
+	var report ReconcileReport
+	files, err := h.Storage.List()
+	if err != nil {
+		return report, err
+	}
+	inStorage := make(map[string]fs.FileInfo, len(files))
+	for _, fi := range files {
+		inStorage[fi.Name()] = fi
+	}
+
+	var missing []*CachedBeatmap
+	for _, b := range h.beatmaps() {
+		name := b.fileName()
+		fi, ok := inStorage[name]
+		delete(inStorage, name)
+
+		b.mtx.Lock()
+		switch {
+		case !b.isDownloaded || b.fileSize == 0:
+			// beatmaps being downloaded may or may not have a file yet,
+			// and beatmaps which could not be downloaded have none.
+		case !ok:
+			missing = append(missing, b)
+		case uint64(fi.Size()) != b.fileSize:
+			report.Resized = append(report.Resized, name)
+			b.fileSize = uint64(fi.Size())
+		}
+		b.mtx.Unlock()
+	}
+
+	// the downloads which finished after the storage was listed have a file
+	// which was not listed.
+	var dropped []*CachedBeatmap
+	for _, b := range missing {
+		name := b.fileName()
+		_, err := h.Storage.Stat(name)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			report.Dropped = append(report.Dropped, name)
+			dropped = append(dropped, b)
+		case err != nil:
+			h.logError("can't check missing file", err, "file", name)
+		}
+	}
+	h.remove(dropped)
+
+	for name, fi := range inStorage {
+		if m := tempFileName.FindStringSubmatch(name); m != nil {
+			if h.removeTempFile(name, m[1]) {
+				report.Broken = append(report.Broken, name)
+			}
+			continue
+		}
+		id, noVideo, ok := parseFileName(name)
+		if !ok {
+			report.Ignored = append(report.Ignored, name)
+			continue
+		}
+		if !readableArchive(h.Storage, fi) {
+			err := h.Storage.Remove(name)
+			switch {
+			case errors.Is(err, fs.ErrNotExist):
+				// evicted after the storage was listed.
+				continue
+			case err != nil:
+				h.logError("can't remove broken file", err, "file", name)
+			}
+			report.Broken = append(report.Broken, name)
+			continue
+		}
+		_, added := h.getOrAdd(beatmapKey{id, noVideo}, func() *CachedBeatmap {
+			return &CachedBeatmap{
+				ID:            id,
+				NoVideo:       noVideo,
+				LastUpdate:    fi.ModTime(),
+				RankedStatus:  UnknownStatus,
+				lastRequested: fi.ModTime(),
+				storage:       h.Storage,
+				fileSize:      uint64(fi.Size()),
+				isDownloaded:  true,
+			}
+		})
+		// a beatmap may have been added to the state by a download in the
+		// meantime: in that case, the file belongs to it.
+		if added {
+			report.Adopted = append(report.Adopted, name)
+		}
+	}
+
+	sort.Strings(report.Dropped)
+	sort.Strings(report.Adopted)
+	sort.Strings(report.Broken)
+	sort.Strings(report.Ignored)
+
+	h.logger().Info("reconciled state with storage",
+		"adopted", len(report.Adopted),
+		"dropped", len(report.Dropped),
+		"resized", len(report.Resized),
+		"broken", len(report.Broken),
+		"ignored", len(report.Ignored),
+	)
+	for _, name := range report.Dropped {
+		h.logger().Warn("dropped missing file", "file", name)
+	}
+	for _, name := range report.Broken {
+		h.logger().Warn("removed broken file", "file", name)
+	}
+	for _, name := range report.Ignored {
+		h.logger().Warn("ignored unknown file", "file", name)
+	}
+
+	if err := h.SaveState(); err != nil {
+		return report, err
+	}
+	h.scheduleCleanup()
+	return report, nil
+}
+
+// removeTempFile removes the temporary file of a beatmap, unless the beatmap
+// is being downloaded, and returns whether it did.
+func (h *House) removeTempFile(name, beatmapName string) bool {
+	id, noVideo, _ := parseFileName(beatmapName)
+	if b := h.Lookup(id, noVideo); b != nil && !b.IsDownloaded() {
+		return false
+	}
+	err := h.Storage.Remove(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		// the download was done after the storage was listed.
+		return false
+	}
+	if err != nil {
+		h.logError("can't remove temporary file", err, "file", name)
+	}
+	return true
+}
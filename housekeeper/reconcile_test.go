@@ -0,0 +1,115 @@
+package housekeeper
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// lateStorage is a Storage whose listing misses a file, like the ones of the
+// downloads which finish while it is being listed.
+type lateStorage struct {
+	LocalStorage
+	late string
+}
+
+func (s lateStorage) List() ([]fs.FileInfo, error) {
+	files, err := s.LocalStorage.List()
+	res := files[:0]
+	for _, fi := range files {
+		if fi.Name() != s.late {
+			res = append(res, fi)
+		}
+	}
+	return res, err
+}
+
+func TestReconcile(t *testing.T) {
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	w, err := zw.Create("beatmap.osu")
+	require.NoError(t, err)
+	w.Write(make([]byte, 20000))
+	require.NoError(t, zw.Close())
+
+	dir := t.TempDir()
+	for name, size := range map[string]int{
+		"1.osz":      15000,
+		"3.osz":      30000,
+		"8.osz":      15000,
+		"readme.txt": 10,
+		// the temporary files of an interrupted download, and of one
+		// still going on.
+		".9.osz.123456.tmp": 5000,
+		".6.osz.654321.tmp": 5000,
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "2n.osz"), archive.Bytes(), 0644))
+	// a download which was interrupted.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "7.osz"), archive.Bytes()[:archive.Len()/2], 0644))
+	modTime := time.Date(2020, 4, 5, 15, 5, 3, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "2n.osz"), modTime, modTime))
+
+	h := New(filepath.Join(t.TempDir(), "cgbin.db"))
+	h.Storage = lateStorage{LocalStorage(dir), "8.osz"}
+	h.setState([]*CachedBeatmap{
+		{ID: 1, fileSize: 15000, isDownloaded: true},
+		{ID: 3, fileSize: 25000, isDownloaded: true},
+		{ID: 4, fileSize: 15000, isDownloaded: true},
+		// beatmaps which could not be downloaded have no file.
+		{ID: 5, isDownloaded: true},
+		// neither may beatmaps that are still being downloaded.
+		{ID: 6},
+		{ID: 8, fileSize: 15000, isDownloaded: true},
+	})
+
+	report, err := h.Reconcile()
+	require.NoError(t, err)
+	require.Equal(t, ReconcileReport{
+		Adopted: []string{"2n.osz"},
+		Dropped: []string{"4.osz"},
+		Resized: []string{"3.osz"},
+		Broken:  []string{".9.osz.123456.tmp", "7.osz"},
+		Ignored: []string{"readme.txt"},
+	}, report)
+	_, err = os.Stat(filepath.Join(dir, "7.osz"))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, ".9.osz.123456.tmp"))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, ".6.osz.654321.tmp"))
+	require.NoError(t, err)
+
+	var ids []int
+	for _, b := range h.Beatmaps() {
+		ids = append(ids, b.ID)
+	}
+	require.Equal(t, []int{1, 2, 3, 5, 6, 8}, ids)
+	require.Equal(t, uint64(30000), h.Lookup(3, false).FileSize())
+
+	adopted := h.Lookup(2, true)
+	require.NotNil(t, adopted)
+	require.True(t, adopted.NoVideo)
+	require.True(t, adopted.IsDownloaded())
+	require.Equal(t, uint64(archive.Len()), adopted.FileSize())
+	require.True(t, modTime.Equal(adopted.LastUpdate))
+	require.True(t, modTime.Equal(adopted.Usage().LastRequested))
+
+	// adopted beatmaps are downloaded again only if the set has been
+	// updated since they were written.
+	b, shouldDownload := h.AcquireBeatmap(&CachedBeatmap{ID: 2, NoVideo: true, LastUpdate: modTime.Add(-time.Hour)})
+	require.Same(t, adopted, b)
+	require.False(t, shouldDownload)
+
+	// running it again must not change anything.
+	report, err = h.Reconcile()
+	require.NoError(t, err)
+	require.Equal(t, ReconcileReport{Ignored: []string{"readme.txt"}}, report)
+	require.NotNil(t, h.Lookup(8, false))
+}
@@ -0,0 +1,560 @@
+package housekeeper
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3Storage is a Storage keeping the files in a bucket of an S3-compatible
+// object store, such as Amazon S3 or MinIO. Objects are addressed using the
+// path style (endpoint/bucket/key), and requests are signed using AWS
+// Signature Version 4.
+//
+// Files being created are written to a temporary file first, and uploaded
+// once they are closed.
+type S3Storage struct {
+	// Endpoint is the base URL of the store, such as
+	// https://s3.eu-central-1.amazonaws.com.
+	Endpoint string
+	Bucket   string
+	Region   string
+	// Prefix is prepended to the names of the files to obtain the keys of
+	// the objects, for instance "cheesegull/".
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// TempDir is the directory where the files are kept until they are
+	// uploaded. If empty, the default directory for temporary files is used.
+	TempDir string
+	// Client is the HTTP client used to make requests. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+}
+
+// emptyPayloadHash is the SHA-256 of an empty payload.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Open opens a file for reading. Reads are done using Range requests, so only
+// the parts of the file which are actually read are downloaded. The requests
+// are cancelled once ctx is done.
+func (s *S3Storage) Open(ctx context.Context, name string) (File, error) {
+	fi, err := s.stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{s: s, ctx: ctx, info: fi}, nil
+}
+
+// Create creates a new file, which is uploaded when the Writer is closed. If
+// ctx is done by then, the file is not uploaded.
+func (s *S3Storage) Create(ctx context.Context, name string) (Writer, error) {
+	f, err := os.CreateTemp(s.TempDir, "cheesegull-*.osz")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{s: s, ctx: ctx, name: name, f: f, hash: sha256.New()}, nil
+}
+
+// Stat returns information about a file.
+func (s *S3Storage) Stat(name string) (fs.FileInfo, error) {
+	fi, err := s.stat(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+func (s *S3Storage) stat(ctx context.Context, name string) (*objectInfo, error) {
+	resp, err := s.do(ctx, "HEAD", s.objectPath(name), nil, nil, nil, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error("HEAD", name, resp)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &objectInfo{name: name, size: resp.ContentLength, modTime: modTime}, nil
+}
+
+// Remove removes a file. Most stores do not report an error when removing an
+// object which does not exist.
+func (s *S3Storage) Remove(name string) error {
+	resp, err := s.do(context.Background(), "DELETE", s.objectPath(name), nil, nil, nil, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	return s3Error("DELETE", name, resp)
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List returns information about all the files having the storage's Prefix.
+// Objects in "subdirectories" of the prefix are not listed.
+func (s *S3Storage) List() ([]fs.FileInfo, error) {
+	var (
+		res   []fs.FileInfo
+		token string
+	)
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.Prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do(context.Background(), "GET", "/"+s.Bucket, q, nil, nil, emptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := s3Error("GET", "bucket listing", resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var page listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range page.Contents {
+			name := strings.TrimPrefix(obj.Key, s.Prefix)
+			if name == "" || strings.Contains(name, "/") {
+				continue
+			}
+			res = append(res, &objectInfo{name: name, size: obj.Size, modTime: obj.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return res, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *S3Storage) objectPath(name string) string {
+	return "/" + s.Bucket + "/" + s.Prefix + name
+}
+
+// do makes a signed request to the store, which is cancelled once ctx is done.
+// path is the unescaped path of the request, and payloadHash the hex-encoded
+// SHA-256 of the body.
+func (s *S3Storage) do(ctx context.Context, method, path string, query url.Values, header http.Header, body io.Reader, payloadHash string) (*http.Response, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.Path += path
+	u.RawPath = awsEscapePath(u.Path)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		if k == "Content-Length" {
+			req.ContentLength, _ = strconv.ParseInt(v[0], 10, 64)
+			continue
+		}
+		req.Header[k] = v
+	}
+	signV4(req, payloadHash, s.AccessKey, s.SecretKey, s.Region, time.Now())
+
+	cl := s.Client
+	if cl == nil {
+		cl = http.DefaultClient
+	}
+	return cl.Do(req)
+}
+
+// s3Error creates an error out of an unexpected response from the store.
+func s3Error(method, name string, resp *http.Response) error {
+	var e struct {
+		Code    string
+		Message string
+	}
+	if method != "HEAD" {
+		// the details of the error are only available if there is a body.
+		xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&e)
+	}
+	if e.Code == "" {
+		e.Code = resp.Status
+	}
+	if e.Message != "" {
+		e.Code += ": " + e.Message
+	}
+	return fmt.Errorf("cheesegull/housekeeper: s3 %s %s: %s", method, name, e.Code)
+}
+
+type objectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (o *objectInfo) Name() string       { return o.name }
+func (o *objectInfo) Size() int64        { return o.size }
+func (o *objectInfo) Mode() fs.FileMode  { return 0444 }
+func (o *objectInfo) ModTime() time.Time { return o.modTime }
+func (o *objectInfo) IsDir() bool        { return false }
+func (o *objectInfo) Sys() interface{}   { return nil }
+
+// s3ReadAtWindow is the least amount of data fetched by ReadAt at once.
+// archive/zip reads archives through many small ReadAt calls, which this way
+// are mostly served without making any request.
+const s3ReadAtWindow = 1 << 20
+
+// s3File reads an object using Range requests. Sequential reads share a
+// single request, which is made again only after a Seek. ReadAt fetches whole
+// windows of the object, and serves the following calls from the last one
+// while they fall inside of it.
+type s3File struct {
+	s    *S3Storage
+	ctx  context.Context
+	info *objectInfo
+	off  int64
+	body io.ReadCloser
+
+	windowMtx sync.Mutex
+	window    []byte
+	windowOff int64
+}
+
+var errS3Closed = errors.New("cheesegull/housekeeper: file already closed")
+
+// get requests the object from off to off+length-1, or to its end if length
+// is negative.
+func (f *s3File) get(off, length int64) (io.ReadCloser, error) {
+	rng := "bytes=" + strconv.FormatInt(off, 10) + "-"
+	if length >= 0 {
+		rng += strconv.FormatInt(off+length-1, 10)
+	}
+	resp, err := f.s.do(f.ctx, "GET", f.s.objectPath(f.info.name), nil, http.Header{"Range": {rng}}, nil, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, &fs.PathError{Op: "read", Path: f.info.name, Err: fs.ErrNotExist}
+	}
+	err = s3Error("GET", f.info.name, resp)
+	resp.Body.Close()
+	return nil, err
+}
+
+func (f *s3File) Read(b []byte) (int, error) {
+	if f.info == nil {
+		return 0, errS3Closed
+	}
+	if f.off >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		body, err := f.get(f.off, -1)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+	n, err := f.body.Read(b)
+	f.off += int64(n)
+	if err == io.EOF && f.off < f.info.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (f *s3File) ReadAt(b []byte, off int64) (int, error) {
+	if f.info == nil {
+		return 0, errS3Closed
+	}
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+	want := int64(len(b))
+	if off+want > f.info.size {
+		want = f.info.size - off
+	}
+	if want == 0 {
+		return 0, nil
+	}
+
+	f.windowMtx.Lock()
+	defer f.windowMtx.Unlock()
+	if off < f.windowOff || off+want > f.windowOff+int64(len(f.window)) {
+		if err := f.fetchWindow(off, want); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b[:want], f.window[off-f.windowOff:])
+	if want < int64(len(b)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fetchWindow fetches a window of the object containing the length bytes from
+// off. f.windowMtx must be held.
+func (f *s3File) fetchWindow(off, length int64) error {
+	if length < s3ReadAtWindow {
+		length = s3ReadAtWindow
+	}
+	start, end := off, off+length
+	if end > f.info.size {
+		// reads near the end are usually followed by reads right before
+		// them, like when archive/zip looks for the central directory.
+		end = f.info.size
+		start = end - length
+		if start < 0 {
+			start = 0
+		}
+	}
+
+	f.window = nil
+	body, err := f.get(start, end-start)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	window := make([]byte, end-start)
+	if _, err := io.ReadFull(body, window); err != nil {
+		return err
+	}
+	f.window, f.windowOff = window, start
+	return nil
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	if f.info == nil {
+		return 0, errS3Closed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, errors.New("cheesegull/housekeeper: negative position")
+	}
+	if offset != f.off && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) {
+	if f.info == nil {
+		return nil, errS3Closed
+	}
+	return f.info, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.info = nil
+	f.window = nil
+	return nil
+}
+
+// s3Writer writes a file to a temporary file, and uploads it when closed.
+type s3Writer struct {
+	s      *S3Storage
+	ctx    context.Context
+	name   string
+	f      *os.File
+	hash   hash.Hash
+	closed bool
+}
+
+func (w *s3Writer) Write(b []byte) (int, error) {
+	n, err := w.f.Write(b)
+	w.hash.Write(b[:n])
+	return n, err
+}
+
+func (w *s3Writer) ReadBack() (ReaderAtCloser, error) {
+	return os.Open(w.f.Name())
+}
+
+// Close uploads the file. Calling Close again does nothing.
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer os.Remove(w.f.Name())
+	defer w.f.Close()
+
+	size, err := w.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	header := http.Header{
+		"Content-Type":   {"application/octet-stream"},
+		"Content-Length": {strconv.FormatInt(size, 10)},
+	}
+	// the body is wrapped so that the http package doesn't try to find out
+	// the length of the file by itself.
+	var body io.Reader = io.LimitReader(w.f, size)
+	if size == 0 {
+		body = http.NoBody
+	}
+	resp, err := w.s.do(w.ctx, "PUT", w.s.objectPath(w.name), nil, header, body, hex.EncodeToString(w.hash.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("PUT", w.name, resp)
+	}
+	return nil
+}
+
+// signV4 signs a request using AWS Signature Version 4, setting its
+// X-Amz-Date, X-Amz-Content-Sha256 and Authorization headers.
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "range" || lk == "content-type" || lk == "content-md5" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscapePath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		",SignedHeaders="+signedHeaders+",Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes a query string the way AWS expects it in the
+// canonical request: sorted, and with spaces encoded as %20.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func awsEscapePath(p string) string {
+	return awsEscape(p, false)
+}
+
+// awsEscape percent-encodes all the characters of s except the unreserved
+// ones, and slashes unless encodeSlash is true.
+func awsEscape(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
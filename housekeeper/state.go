@@ -1,36 +1,115 @@
 package housekeeper
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"io/fs"
+	"math"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// Verification is the result of the verification of the contents of a
+// CachedBeatmap against the beatmaps it should contain.
+type Verification uint8
+
+// These are the possible results of a verification.
+const (
+	NotVerified Verification = iota
+	VerificationPassed
+	VerificationFailed
+)
+
+func (v Verification) String() string {
+	switch v {
+	case VerificationPassed:
+		return "passed"
+	case VerificationFailed:
+		return "failed"
+	}
+	return "not verified"
+}
+
+// UnknownStatus is the RankedStatus of the beatmaps whose ranked status is not
+// known, such as those cached by older versions of CheeseGull.
+const UnknownStatus = math.MinInt8
+
 // CachedBeatmap represents a beatmap that is held in the cache of CheeseGull.
 type CachedBeatmap struct {
 	ID         int
 	NoVideo    bool
 	LastUpdate time.Time
+	// RankedStatus is the ranked status of the set, as in models.Set. It is
+	// used to apply the House's Quotas. As 0 is the status of pending sets,
+	// AcquireBeatmap ignores it: use SetRankedStatus instead.
+	RankedStatus int
 
 	lastRequested time.Time
+	requests      uint64
 
+	storage      Storage
 	fileSize     uint64
 	isDownloaded bool
+	verification Verification
+	progress     *progress
 	mtx          sync.RWMutex
 	waitGroup    sync.WaitGroup
 }
 
-// File opens the File of the beatmap from the filesystem.
-func (c *CachedBeatmap) File() (*os.File, error) {
-	return os.Open(c.fileName())
+// File opens the File of the beatmap from the storage. Once ctx is done,
+// reading it may fail.
+func (c *CachedBeatmap) File(ctx context.Context) (File, error) {
+	return c.storage.Open(ctx, c.fileName())
 }
 
-// CreateFile creates the File of the beatmap in the filesystem, and returns it
-// in write mode.
-func (c *CachedBeatmap) CreateFile() (*os.File, error) {
-	return os.Create(c.fileName())
+// CreateFile creates the File of the beatmap in the storage, and returns it
+// in write mode. While the beatmap is being downloaded, everything written to
+// it can immediately be read by the readers returned by Stream. Once ctx is
+// done, writing it may fail.
+func (c *CachedBeatmap) CreateFile(ctx context.Context) (io.WriteCloser, error) {
+	w, err := c.storage.Create(ctx, c.fileName())
+	if err != nil {
+		return nil, err
+	}
+
+	c.mtx.RLock()
+	p := c.progress
+	c.mtx.RUnlock()
+	if p == nil {
+		return w, nil
+	}
+
+	rf, err := w.ReadBack()
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	p.start(rf)
+	return &progressWriter{f: w, p: p}, nil
+}
+
+// Stream returns a reader for the File of the beatmap. If the beatmap is still
+// being downloaded, the reader follows the download as it goes on, waiting for
+// new data to be written until ctx is done; if the download fails, the reader
+// returns its error after reading all the data that was received. If the
+// beatmap could not be downloaded at all, the reader is empty.
+func (c *CachedBeatmap) Stream(ctx context.Context) (io.ReadCloser, error) {
+	c.mtx.RLock()
+	p := c.progress
+	c.mtx.RUnlock()
+	if p != nil && p.acquire() {
+		return &streamReader{p: p, ctx: ctx, stop: p.wakeOnDone(ctx)}, nil
+	}
+
+	c.MustBeDownloaded()
+	if c.FileSize() == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	return c.File(ctx)
 }
 
 func (c *CachedBeatmap) fileName() string {
@@ -38,7 +117,14 @@ func (c *CachedBeatmap) fileName() string {
 	if c.NoVideo {
 		n = "n"
 	}
-	return "data/" + strconv.Itoa(c.ID) + n + ".osz"
+	return strconv.Itoa(c.ID) + n + ".osz"
+}
+
+func (c *CachedBeatmap) status() int {
+	c.mtx.RLock()
+	s := c.RankedStatus
+	c.mtx.RUnlock()
+	return s
 }
 
 // IsDownloaded checks whether the beatmap has been downloaded.
@@ -66,14 +152,83 @@ func (c *CachedBeatmap) MustBeDownloaded() {
 	c.waitGroup.Wait()
 }
 
+// WaitDownloaded waits for the beatmap to be downloaded, like
+// MustBeDownloaded, but gives up once ctx is done, returning its error.
+func (c *CachedBeatmap) WaitDownloaded(ctx context.Context) error {
+	if c.IsDownloaded() {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		c.waitGroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CancelWhenAbandoned makes the download of the beatmap call cancel when all
+// the readers obtained through Stream have been closed before the download
+// was done, meaning there's nobody waiting for it anymore.
+func (c *CachedBeatmap) CancelWhenAbandoned(cancel context.CancelFunc) {
+	c.mtx.RLock()
+	p := c.progress
+	c.mtx.RUnlock()
+	if p != nil {
+		p.setAbandoned(cancel)
+	}
+}
+
 // DownloadCompleted must be called once the beatmap has finished downloading.
 func (c *CachedBeatmap) DownloadCompleted(fileSize uint64, parentHouse *House) {
+	c.finishDownload(fileSize, nil)
+	parentHouse.finishedDownload(c)
+	parentHouse.scheduleCleanup()
+}
+
+// DownloadFailed must be called instead of DownloadCompleted if the download
+// of the beatmap failed midway. The partially written file is removed, and the
+// readers following the download will return err.
+func (c *CachedBeatmap) DownloadFailed(err error, parentHouse *House) {
+	rmErr := c.storage.Remove(c.fileName())
+	if rmErr != nil && !errors.Is(rmErr, fs.ErrNotExist) {
+		parentHouse.logError("can't remove partially downloaded beatmap", rmErr, "set_id", c.ID, "no_video", c.NoVideo)
+	}
+	c.finishDownload(0, err)
+	parentHouse.finishedDownload(c)
+	parentHouse.scheduleCleanup()
+}
+
+func (c *CachedBeatmap) finishDownload(fileSize uint64, err error) {
 	c.mtx.Lock()
 	c.fileSize = fileSize
 	c.isDownloaded = true
+	p := c.progress
+	c.progress = nil
 	c.mtx.Unlock()
 	c.waitGroup.Done()
-	parentHouse.scheduleCleanup()
+	if p != nil {
+		p.finish(err)
+	}
+}
+
+// Verification returns the result of the last verification of the beatmap.
+func (c *CachedBeatmap) Verification() Verification {
+	c.mtx.RLock()
+	v := c.verification
+	c.mtx.RUnlock()
+	return v
+}
+
+// SetVerification sets the result of the verification of the beatmap.
+func (c *CachedBeatmap) SetVerification(v Verification) {
+	c.mtx.Lock()
+	c.verification = v
+	c.mtx.Unlock()
 }
 
 // SetLastRequested changes the last requested time.
@@ -83,6 +238,35 @@ func (c *CachedBeatmap) SetLastRequested(t time.Time) {
 	c.mtx.Unlock()
 }
 
+// SetRankedStatus sets the ranked status of the beatmap. UnknownStatus is
+// ignored, so that a known status is never forgotten.
+func (c *CachedBeatmap) SetRankedStatus(status int) {
+	if status == UnknownStatus {
+		return
+	}
+	c.mtx.Lock()
+	c.RankedStatus = status
+	c.mtx.Unlock()
+}
+
+// Requests returns the number of times the beatmap has been requested.
+func (c *CachedBeatmap) Requests() uint64 {
+	c.mtx.RLock()
+	r := c.requests
+	c.mtx.RUnlock()
+	return r
+}
+
+// Requested records a request for a beatmap, updating its last requested time
+// and its number of requests, and notifying the eviction policy.
+func (h *House) Requested(c *CachedBeatmap) {
+	c.mtx.Lock()
+	c.lastRequested = time.Now()
+	c.requests++
+	c.mtx.Unlock()
+	h.Policy.Requested(c)
+}
+
 func (c *CachedBeatmap) String() string {
 	return fmt.Sprintf("{ID: %d NoVideo: %t LastUpdate: %v}", c.ID, c.NoVideo, c.LastUpdate)
 }
@@ -94,7 +278,9 @@ func (c *CachedBeatmap) String() string {
 // that of the beatmap stored in the state, then the beatmap in the state's
 // downloaded status is switched back to false and the LastUpdate is changed.
 // true is also returned, indicating that the caller now has the burden of
-// downloading the beatmap.
+// downloading the beatmap. If the beatmap in the state is still being
+// downloaded, it is returned alongside with false: its download can be
+// followed using Stream.
 //
 // In the case the cachedbeatmap has not been stored in the state, then
 // it is added to the state and, like the case where LastUpdated has been
@@ -120,47 +306,54 @@ func (h *House) AcquireBeatmap(c *CachedBeatmap) (*CachedBeatmap, bool) {
 		return nil, false
 	}
 
-	h.stateMutex.Lock()
-	for _, b := range h.state {
-		// if the id or novideo is different, then all is good and we
-		// can proceed with the next element.
-		if b.ID != c.ID || b.NoVideo != c.NoVideo {
-			continue
-		}
-		// unlocking because in either branch, we will return.
-		h.stateMutex.Unlock()
-
-		b.mtx.Lock()
-		// if c is not newer than b, then just return.
-		if !b.LastUpdate.Before(c.LastUpdate) {
-			b.mtx.Unlock()
-			if b.FileSize() == 0 {
-				// Try re-downloading beatmaps if their size is 0
-				b.waitGroup.Add(1)
-				return b, true
-			}
-			// If size is ok, do not redownload
-			return b, false
+	// we need to recreate the CachedBeatmap: this way we can be sure the zero
+	// is set for the unexported fields.
+	b, added := h.getOrAdd(c.key(), func() *CachedBeatmap {
+		n := &CachedBeatmap{
+			ID:           c.ID,
+			NoVideo:      c.NoVideo,
+			LastUpdate:   c.LastUpdate,
+			RankedStatus: UnknownStatus,
+			storage:      h.Storage,
+			progress:     newProgress(),
 		}
-
-		b.LastUpdate = c.LastUpdate
-		b.mtx.Unlock()
-		b.waitGroup.Add(1)
+		n.waitGroup.Add(1)
+		return n
+	})
+	if added {
+		// c was not present in our state: the caller must download it.
+		h.startedDownload(b)
 		return b, true
 	}
 
-	// c was not present in our state: we need to add it.
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if !b.isDownloaded {
+		// somebody else is already downloading the beatmap: the caller
+		// can follow the download using Stream.
+		return b, false
+	}
+	// if c is not newer than b, and b's size is ok, there's no need to
+	// download it again. Beatmaps with a size of 0 are downloaded again,
+	// as the previous attempt likely failed.
+	if !b.LastUpdate.Before(c.LastUpdate) && b.fileSize != 0 {
+		return b, false
+	}
 
-	// we need to recreate the CachedBeatmap: this way we can be sure the zero
-	// is set for the unexported fields.
-	n := &CachedBeatmap{
-		ID:         c.ID,
-		NoVideo:    c.NoVideo,
-		LastUpdate: c.LastUpdate,
+	if b.LastUpdate.Before(c.LastUpdate) {
+		b.LastUpdate = c.LastUpdate
 	}
-	h.state = append(h.state, n)
-	h.stateMutex.Unlock()
+	b.isDownloaded = false
+	b.verification = NotVerified
+	b.progress = newProgress()
+	b.waitGroup.Add(1)
+	h.startedDownload(b)
+	return b, true
+}
 
-	n.waitGroup.Add(1)
-	return n, true
+// Lookup returns the CachedBeatmap in the state with the given ID and NoVideo,
+// or nil if there is none. Unlike AcquireBeatmap, it never adds a beatmap to
+// the state.
+func (h *House) Lookup(id int, noVideo bool) *CachedBeatmap {
+	return h.get(beatmapKey{id, noVideo})
 }
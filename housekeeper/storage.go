@@ -0,0 +1,196 @@
+package housekeeper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Storage is where the files of the cached beatmaps are kept. Names are
+// simple file names, such as "1234n.osz", without any directory.
+//
+// Errors for files which do not exist must satisfy
+// errors.Is(err, fs.ErrNotExist).
+type Storage interface {
+	// Open opens a file for reading. Once ctx is done, reading the file may
+	// fail.
+	Open(ctx context.Context, name string) (File, error)
+	// Create creates a file, replacing any existing file with the same name.
+	// The file is guaranteed to be complete only once the returned Writer
+	// has been closed without errors. Once ctx is done, writing or closing
+	// the file may fail.
+	Create(ctx context.Context, name string) (Writer, error)
+	// Stat returns information about a file.
+	Stat(name string) (fs.FileInfo, error)
+	// Remove removes a file.
+	Remove(name string) error
+	// List returns information about all the files in the storage.
+	List() ([]fs.FileInfo, error)
+}
+
+// File is a file opened from a Storage.
+type File interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+	Stat() (fs.FileInfo, error)
+}
+
+// ReaderAtCloser is the interface that groups the ReadAt and Close methods.
+type ReaderAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// Writer is a file being written to a Storage.
+type Writer interface {
+	io.WriteCloser
+	// ReadBack opens an independent reader for the data written to the file,
+	// so that it can be read while it is still being written. The reader
+	// keeps working after the Writer has been closed, until it is closed
+	// itself.
+	ReadBack() (ReaderAtCloser, error)
+}
+
+// LocalStorage is a Storage keeping the files in a directory of the local
+// filesystem.
+type LocalStorage string
+
+// Open opens a file for reading. Local files are read regardless of ctx.
+func (s LocalStorage) Open(ctx context.Context, name string) (File, error) {
+	return os.Open(s.path(name))
+}
+
+// Create creates a file in the directory, creating the directory itself if it
+// does not exist yet. The data is written to a temporary file, which is given
+// its name only once the Writer is closed, so that a file cut short by a
+// crash is never mistaken for a complete one. Local files are written
+// regardless of ctx.
+func (s LocalStorage) Create(ctx context.Context, name string) (Writer, error) {
+	pattern := "." + filepath.Base(name) + ".*.tmp"
+	f, err := os.CreateTemp(string(s), pattern)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(string(s), 0755); err != nil {
+			return nil, err
+		}
+		f, err = os.CreateTemp(string(s), pattern)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{File: f, name: s.path(name)}, nil
+}
+
+// Stat returns information about a file.
+func (s LocalStorage) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(s.path(name))
+}
+
+// Remove removes a file.
+func (s LocalStorage) Remove(name string) error {
+	return os.Remove(s.path(name))
+}
+
+// List returns information about all the files in the directory. If the
+// directory does not exist, the list is empty.
+func (s LocalStorage) List() ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(string(s))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := make([]fs.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		fi, err := e.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// removed while we were listing the directory.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, fi)
+	}
+	return res, nil
+}
+
+func (s LocalStorage) path(name string) string {
+	return filepath.Join(string(s), filepath.Base(name))
+}
+
+// localWriter writes to a temporary file, which is renamed to name when it is
+// closed.
+type localWriter struct {
+	*os.File
+	name   string
+	closed bool
+}
+
+func (w *localWriter) ReadBack() (ReaderAtCloser, error) {
+	return os.Open(w.File.Name())
+}
+
+// Close closes the file and gives it its name. Calling Close again does
+// nothing.
+func (w *localWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	if err := os.Rename(w.File.Name(), w.name); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	return nil
+}
+
+// storageCheckTTL is how long CheckStorage reuses the result of its last
+// check of the Storage.
+const storageCheckTTL = time.Second * 30
+
+// CheckStorage checks that beatmaps can be written to the Storage, by writing
+// a small file to it and removing it. As it may be called by every probe of a
+// load balancer, the result is reused for storageCheckTTL, and concurrent
+// calls wait for the same check.
+func (h *House) CheckStorage(ctx context.Context) error {
+	h.storageCheckMutex.Lock()
+	defer h.storageCheckMutex.Unlock()
+	if !h.storageChecked.IsZero() && time.Since(h.storageChecked) < storageCheckTTL {
+		return h.storageCheckErr
+	}
+	err := h.checkStorage(ctx)
+	if ctx.Err() == nil {
+		// when ctx is done, the failure says nothing about the Storage.
+		h.storageChecked, h.storageCheckErr = time.Now(), err
+	}
+	return err
+}
+
+func (h *House) checkStorage(ctx context.Context) error {
+	name := fmt.Sprintf("probe-%d", time.Now().UnixNano())
+	w, err := h.Storage.Create(ctx, name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte("cheesegull"))
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if rmErr := h.Storage.Remove(name); err == nil && !errors.Is(rmErr, fs.ErrNotExist) {
+		err = rmErr
+	}
+	return err
+}
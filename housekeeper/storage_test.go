@@ -0,0 +1,123 @@
+package housekeeper
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testStorage runs the operations every Storage must support.
+func testStorage(t *testing.T, s Storage) {
+	ctx := context.Background()
+	files, err := s.List()
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	_, err = s.Open(ctx, "1.osz")
+	require.True(t, errors.Is(err, fs.ErrNotExist), "got %v", err)
+	_, err = s.Stat("1.osz")
+	require.True(t, errors.Is(err, fs.ErrNotExist), "got %v", err)
+
+	w, err := s.Create(ctx, "1.osz")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("PK\x03\x04 beatmap"))
+	require.NoError(t, err)
+	rb, err := w.ReadBack()
+	require.NoError(t, err)
+	_, err = w.Write([]byte(" set"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	// the data must still be readable after the writer is closed
+	buf := make([]byte, 4)
+	_, err = rb.ReadAt(buf, 12)
+	require.NoError(t, err)
+	require.Equal(t, " set", string(buf))
+	require.NoError(t, rb.Close())
+
+	w, err = s.Create(ctx, "2n.osz")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	fi, err := s.Stat("1.osz")
+	require.NoError(t, err)
+	require.Equal(t, int64(16), fi.Size())
+
+	f, err := s.Open(ctx, "1.osz")
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, "PK\x03\x04 beatmap set", string(data))
+	_, err = f.Seek(5, io.SeekStart)
+	require.NoError(t, err)
+	data, err = io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, "beatmap set", string(data))
+	n, err := f.ReadAt(buf, 14)
+	require.Equal(t, 2, n)
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, f.Close())
+
+	files, err = s.List()
+	require.NoError(t, err)
+	var names []string
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	require.Equal(t, []string{"1.osz", "2n.osz"}, names)
+
+	require.NoError(t, s.Remove("1.osz"))
+	_, err = s.Stat("1.osz")
+	require.True(t, errors.Is(err, fs.ErrNotExist), "got %v", err)
+}
+
+func TestLocalStorage(t *testing.T) {
+	// the directory is created when the first file is.
+	testStorage(t, LocalStorage(filepath.Join(t.TempDir(), "data")))
+}
+
+func TestLocalStorageCreateIsAtomic(t *testing.T) {
+	s := LocalStorage(t.TempDir())
+	ctx := context.Background()
+	w, err := s.Create(ctx, "1.osz")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("PK\x03\x04 half a beatmap"))
+	require.NoError(t, err)
+
+	// until the writer is closed, the file has no name.
+	_, err = s.Stat("1.osz")
+	require.True(t, errors.Is(err, fs.ErrNotExist), "got %v", err)
+
+	require.NoError(t, w.Close())
+	require.NoError(t, w.Close())
+	fi, err := s.Stat("1.osz")
+	require.NoError(t, err)
+	require.Equal(t, int64(19), fi.Size())
+	files, err := s.List()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
+
+func TestCheckStorage(t *testing.T) {
+	h := New(newTestFolder(t).path)
+	h.Storage = LocalStorage(t.TempDir())
+	require.NoError(t, h.CheckStorage(context.Background()))
+	files, err := h.Storage.List()
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	// the directory can't be created, as there is a file in its place.
+	h.Storage = LocalStorage(filepath.Join(h.FilePath, "data"))
+	require.NoError(t, h.SaveState())
+	// the result of the last check is reused for a while.
+	require.NoError(t, h.CheckStorage(context.Background()))
+	h.storageChecked = time.Time{}
+	require.Error(t, h.CheckStorage(context.Background()))
+}
@@ -0,0 +1,201 @@
+package housekeeper
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// progress keeps track of a beatmap that is currently being downloaded, so
+// that the part of the file which has already been written can be read by any
+// number of requesters while the download is still going on.
+type progress struct {
+	mtx  sync.Mutex
+	cond *sync.Cond
+
+	// f is a read-only handle to the file being written. It is shared by all
+	// readers through ReadAt, and closed once the download is done and no
+	// reader is using it anymore.
+	f       ReaderAtCloser
+	refs    int
+	closed  bool
+	written int64
+	done    bool
+	err     error
+
+	// abandoned, if set, is called when all the readers have gone away
+	// before the download was done.
+	abandoned func()
+}
+
+func newProgress() *progress {
+	p := &progress{}
+	p.cond = sync.NewCond(&p.mtx)
+	return p
+}
+
+// start sets the file from which the readers will read.
+func (p *progress) start(f ReaderAtCloser) {
+	p.mtx.Lock()
+	p.f = f
+	p.mtx.Unlock()
+}
+
+// wrote notifies the readers that n more bytes are available.
+func (p *progress) wrote(n int) {
+	if n <= 0 {
+		return
+	}
+	p.mtx.Lock()
+	p.written += int64(n)
+	p.mtx.Unlock()
+	p.cond.Broadcast()
+}
+
+// finish marks the download as completed. If err is not nil, readers will
+// return it once they have read everything that had been written up to this
+// point.
+func (p *progress) finish(err error) {
+	p.mtx.Lock()
+	p.done = true
+	p.err = err
+	p.closeIfUnused()
+	p.mtx.Unlock()
+	p.cond.Broadcast()
+}
+
+// acquire registers a new reader. It returns false if the download has
+// already finished and the file has been closed, in which case the caller
+// should read the file from the filesystem instead.
+func (p *progress) acquire() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.closed {
+		return false
+	}
+	p.refs++
+	return true
+}
+
+// release unregisters a reader.
+func (p *progress) release() {
+	p.mtx.Lock()
+	p.refs--
+	var abandoned func()
+	if p.refs == 0 && !p.done {
+		abandoned = p.abandoned
+	}
+	p.closeIfUnused()
+	p.mtx.Unlock()
+	if abandoned != nil {
+		abandoned()
+	}
+}
+
+// setAbandoned sets the function to be called when all readers go away
+// before the download is done.
+func (p *progress) setAbandoned(f func()) {
+	p.mtx.Lock()
+	p.abandoned = f
+	p.mtx.Unlock()
+}
+
+// wakeOnDone wakes up the readers waiting for data when ctx is done. The
+// returned function must be called to release the resources associated with
+// it.
+func (p *progress) wakeOnDone(ctx context.Context) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		// taking the lock makes sure that waiting readers have either not
+		// checked the context yet, or are already waiting on the cond.
+		p.mtx.Lock()
+		p.mtx.Unlock()
+		p.cond.Broadcast()
+	})
+}
+
+// closeIfUnused must be called with p.mtx held.
+func (p *progress) closeIfUnused() {
+	if p.refs > 0 || !p.done || p.closed {
+		return
+	}
+	p.closed = true
+	if p.f != nil {
+		p.f.Close()
+	}
+}
+
+// wait blocks until there is some data to be read past off, the download has
+// finished or ctx is done. It returns the number of bytes which can be read
+// from off, or if there are none the error that the reader should return.
+func (p *progress) wait(ctx context.Context, off int64) (int64, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for p.written <= off && !p.done {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		p.cond.Wait()
+	}
+	if p.written > off {
+		return p.written - off, nil
+	}
+	if p.err != nil {
+		return 0, p.err
+	}
+	return 0, io.EOF
+}
+
+// progressWriter writes to the file of a beatmap being downloaded, and
+// notifies readers of what has been written.
+type progressWriter struct {
+	f io.WriteCloser
+	p *progress
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.f.Write(b)
+	w.p.wrote(n)
+	return n, err
+}
+
+func (w *progressWriter) Close() error {
+	return w.f.Close()
+}
+
+// streamReader reads a file while it is being downloaded.
+type streamReader struct {
+	p      *progress
+	ctx    context.Context
+	stop   func() bool
+	off    int64
+	closed bool
+}
+
+func (r *streamReader) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	avail, err := r.p.wait(r.ctx, r.off)
+	if avail == 0 {
+		return 0, err
+	}
+	if int64(len(b)) > avail {
+		b = b[:avail]
+	}
+	n, err := r.p.f.ReadAt(b, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n == len(b) {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *streamReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.stop()
+	r.p.release()
+	return nil
+}
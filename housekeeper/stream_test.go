@@ -0,0 +1,141 @@
+package housekeeper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestProgress creates a progress and a writer for a file in a temporary
+// folder, like CachedBeatmap.CreateFile does.
+func newTestProgress(t *testing.T) (*progress, io.WriteCloser) {
+	name := filepath.Join(t.TempDir(), "1.osz")
+	f, err := os.Create(name)
+	require.NoError(t, err)
+	rf, err := os.Open(name)
+	require.NoError(t, err)
+
+	p := newProgress()
+	p.start(rf)
+	return p, &progressWriter{f: f, p: p}
+}
+
+func readStream(t *testing.T, p *progress, wg *sync.WaitGroup, res *[]byte, resErr *error) {
+	require.True(t, p.acquire())
+	r := &streamReader{p: p, ctx: context.Background(), stop: func() bool { return true }}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer r.Close()
+		*res, *resErr = io.ReadAll(r)
+	}()
+}
+
+func TestStreamFanOut(t *testing.T) {
+	p, w := newTestProgress(t)
+
+	const readers = 8
+	var (
+		wg   sync.WaitGroup
+		res  [readers][]byte
+		errs [readers]error
+	)
+	for i := 0; i < readers; i++ {
+		readStream(t, p, &wg, &res[i], &errs[i])
+	}
+
+	data := bytes.Repeat([]byte("cheesegull"), 10000)
+	for i := 0; i < len(data); i += 4096 {
+		end := i + 4096
+		if end > len(data) {
+			end = len(data)
+		}
+		_, err := w.Write(data[i:end])
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	p.finish(nil)
+
+	wg.Wait()
+	for i := 0; i < readers; i++ {
+		require.NoError(t, errs[i])
+		require.Equal(t, data, res[i])
+	}
+	require.True(t, p.closed)
+}
+
+func TestStreamFailure(t *testing.T) {
+	p, w := newTestProgress(t)
+
+	var (
+		wg  sync.WaitGroup
+		res []byte
+		err error
+	)
+	readStream(t, p, &wg, &res, &err)
+
+	_, wErr := w.Write([]byte("PK\x03\x04 half a beatmap"))
+	require.NoError(t, wErr)
+	require.NoError(t, w.Close())
+	downloadErr := errors.New("connection reset by peer")
+	p.finish(downloadErr)
+
+	wg.Wait()
+	require.Equal(t, downloadErr, err)
+	require.Equal(t, []byte("PK\x03\x04 half a beatmap"), res)
+}
+
+func TestStreamNotStarted(t *testing.T) {
+	p := newProgress()
+
+	var (
+		wg  sync.WaitGroup
+		res []byte
+		err error
+	)
+	readStream(t, p, &wg, &res, &err)
+	p.finish(nil)
+
+	wg.Wait()
+	require.NoError(t, err)
+	require.Empty(t, res)
+
+	// once the download is finished and nobody is reading, readers must use
+	// the file in the filesystem.
+	require.False(t, p.acquire())
+}
+
+func TestStreamAbandoned(t *testing.T) {
+	p, w := newTestProgress(t)
+	defer w.Close()
+
+	abandoned := make(chan struct{})
+	p.setAbandoned(func() { close(abandoned) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	require.True(t, p.acquire())
+	r := &streamReader{p: p, ctx: ctx, stop: p.wakeOnDone(ctx)}
+
+	_, err := w.Write([]byte("PK\x03\x04"))
+	require.NoError(t, err)
+
+	errCh := make(chan error)
+	go func() {
+		_, err := io.ReadAll(r)
+		errCh <- err
+	}()
+
+	// the reader is waiting for more data: cancelling its context must wake
+	// it up, and closing the last reader must abandon the download.
+	cancel()
+	require.Equal(t, context.Canceled, <-errCh)
+	require.NoError(t, r.Close())
+	<-abandoned
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+
+	"github.com/osuripple/cheesegull/models"
+)
+
+var (
+	keyCmd = kingpin.Command("key", "Manage the API keys.")
+
+	keyCreateCmd    = keyCmd.Command("create", "Create a new API key, and print it.")
+	keyCreateName   = keyCreateCmd.Arg("name", "Name of the key, to remember who it was given to.").Required().String()
+	keyCreateScopes = keyCreateCmd.Flag("scopes", "Comma-separated list of the scopes of the key: download, download-unranked, search, admin.").Default("download,search").String()
+
+	keyListCmd = keyCmd.Command("list", "List the API keys.")
+
+	keyRevokeCmd = keyCmd.Command("revoke", "Revoke an API key. Running instances may keep accepting it for up to a minute.")
+	keyRevokeID  = keyRevokeCmd.Arg("id", "ID of the key, as shown by key list.").Required().Int()
+)
+
+// keysDB opens the database for the key commands, making sure it is up to
+// date.
+func keysDB() *sql.DB {
+	db, err := sql.Open("mysql", addTimeParsing(*mysqlDSN))
+	if err == nil {
+		err = models.RunMigrations(db)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return db
+}
+
+func createKey() {
+	db := keysDB()
+	key, err := models.CreateAPIKey(db, *keyCreateName, commaSeparated(*keyCreateScopes))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println(key)
+}
+
+func listKeys() {
+	db := keysDB()
+	keys, err := models.FetchAPIKeys(db)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for _, k := range keys {
+		fmt.Printf("%d\t%s\t%s\t%s\n", k.ID, k.Name, strings.Join(k.Scopes, ","), k.CreatedAt.Format("2006-01-02 15:04:05"))
+	}
+}
+
+func revokeKey() {
+	db := keysDB()
+	ok, err := models.RevokeAPIKey(db, *keyRevokeID)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if !ok {
+		fmt.Println("No key with ID", *keyRevokeID)
+		os.Exit(1)
+	}
+	fmt.Println("Revoked key", *keyRevokeID)
+}
@@ -0,0 +1,337 @@
+// Package metrics keeps counters, gauges and histograms about CheeseGull, and
+// writes them in the text format of Prometheus.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry is a set of metrics, written together by WriteTo.
+type Registry struct {
+	mtx     sync.Mutex
+	metrics map[string]metric
+}
+
+// Default is the Registry in which the New functions register the metrics.
+var Default = &Registry{}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// register adds a metric to the registry. Registering two metrics with the
+// same name is a programming error, so it panics.
+func (r *Registry) register(name string, m metric) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.metrics == nil {
+		r.metrics = make(map[string]metric)
+	}
+	if _, ok := r.metrics[name]; ok {
+		panic("cheesegull/metrics: duplicate metric " + name)
+	}
+	r.metrics[name] = m
+}
+
+// WriteTo writes all the metrics to w, sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mtx.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, len(names))
+	for i, name := range names {
+		metrics[i] = r.metrics[name]
+	}
+	r.mtx.Unlock()
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// desc describes a metric, and the labels of its series.
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// key returns the key of the series with the given label values.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("cheesegull/metrics: %s has %d labels, got %d values", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeSample writes a sample of a series. extra is an additional label,
+// such as the le label of the buckets of histograms.
+func (d *desc) writeSample(w *bufio.Writer, suffix string, values []string, extraName, extraValue string, v float64) {
+	w.WriteString(d.name)
+	w.WriteString(suffix)
+	if len(values) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, l := range d.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, l, labelValueReplacer.Replace(values[i]))
+		}
+		if extraName != "" {
+			if len(values) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// series are the series of a Counter or a Gauge.
+type series struct {
+	desc
+	mtx    sync.Mutex
+	values map[string]*seriesValue
+}
+
+type seriesValue struct {
+	labels []string
+	v      float64
+}
+
+func (s *series) add(v float64, labels []string) {
+	k := s.key(labels)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]*seriesValue)
+	}
+	sv := s.values[k]
+	if sv == nil {
+		sv = &seriesValue{labels: append([]string{}, labels...)}
+		s.values[k] = sv
+	}
+	sv.v += v
+}
+
+func (s *series) set(v float64, labels []string) {
+	k := s.key(labels)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]*seriesValue)
+	}
+	s.values[k] = &seriesValue{labels: append([]string{}, labels...), v: v}
+}
+
+func (s *series) write(w *bufio.Writer) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.writeHeader(w)
+	if len(s.labels) == 0 && len(s.values) == 0 {
+		// metrics without labels always have a value.
+		s.writeSample(w, "", nil, "", "", 0)
+		return
+	}
+	keys := make([]string, 0, len(s.values))
+	for k := range s.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		sv := s.values[k]
+		s.writeSample(w, "", sv.labels, "", "", sv.v)
+	}
+}
+
+// Counter is a value which only ever goes up, such as the number of requests
+// handled, split in series by the values of its labels.
+type Counter struct {
+	s series
+}
+
+// NewCounter registers a new Counter in the Default registry.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{s: series{desc: desc{name, help, "counter", labels}}}
+	Default.register(name, &c.s)
+	return c
+}
+
+// Add adds v to the series with the given label values. v must not be
+// negative.
+func (c *Counter) Add(v float64, labels ...string) {
+	c.s.add(v, labels)
+}
+
+// Inc adds 1 to the series with the given label values.
+func (c *Counter) Inc(labels ...string) {
+	c.s.add(1, labels)
+}
+
+// Gauge is a value which can go up and down, split in series by the values of
+// its labels.
+type Gauge struct {
+	s series
+}
+
+// NewGauge registers a new Gauge in the Default registry.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{s: series{desc: desc{name, help, "gauge", labels}}}
+	Default.register(name, &g.s)
+	return g
+}
+
+// Set sets the series with the given label values to v.
+func (g *Gauge) Set(v float64, labels ...string) {
+	g.s.set(v, labels)
+}
+
+// Add adds v to the series with the given label values.
+func (g *Gauge) Add(v float64, labels ...string) {
+	g.s.add(v, labels)
+}
+
+// gaugeFunc is a gauge whose value is taken from a function every time it is
+// written.
+type gaugeFunc struct {
+	desc
+	f func() float64
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	g.writeSample(w, "", nil, "", "", g.f())
+}
+
+// NewGaugeFunc registers in the Default registry a gauge without labels,
+// whose value is returned by f every time the metrics are written. f must be
+// safe to call concurrently.
+func NewGaugeFunc(name, help string, f func() float64) {
+	Default.register(name, &gaugeFunc{desc{name, help, "gauge", nil}, f})
+}
+
+// DefBuckets are the default buckets of a Histogram, in seconds, suited to
+// measure the latency of requests.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observations, such as the latency of requests, in
+// buckets, split in series by the values of its labels.
+type Histogram struct {
+	desc
+	buckets []float64
+	mtx     sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram registers a new Histogram in the Default registry. buckets are
+// the upper bounds of the buckets, in ascending order; if nil, DefBuckets is
+// used.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	h := &Histogram{
+		desc:    desc{name, help, "histogram", labels},
+		buckets: buckets,
+	}
+	Default.register(name, h)
+	return h
+}
+
+// Observe adds an observation to the series with the given label values.
+func (h *Histogram) Observe(v float64, labels ...string) {
+	k := h.key(labels)
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.values == nil {
+		h.values = make(map[string]*histogramValue)
+	}
+	hv := h.values[k]
+	if hv == nil {
+		hv = &histogramValue{
+			labels: append([]string{}, labels...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.values[k] = hv
+	}
+	// the count of a bucket includes all the observations less than or
+	// equal to its upper bound, so the counts are cumulative.
+	for i := len(h.buckets) - 1; i >= 0 && v <= h.buckets[i]; i-- {
+		hv.counts[i]++
+	}
+	hv.sum += v
+	hv.count++
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.writeHeader(w)
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hv := h.values[k]
+		for i, b := range h.buckets {
+			h.writeSample(w, "_bucket", hv.labels, "le", formatFloat(b), float64(hv.counts[i]))
+		}
+		h.writeSample(w, "_bucket", hv.labels, "le", "+Inf", float64(hv.count))
+		h.writeSample(w, "_sum", hv.labels, "", "", hv.sum)
+		h.writeSample(w, "_count", hv.labels, "", "", float64(hv.count))
+	}
+}
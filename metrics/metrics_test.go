@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteTo(t *testing.T) {
+	old := Default
+	Default = &Registry{}
+	t.Cleanup(func() { Default = old })
+
+	c := NewCounter("test_requests_total", "Number of requests.", "route", "code")
+	c.Inc("/d/:id", "200")
+	c.Add(2, "/d/:id", "200")
+	c.Inc("/api/search", "429")
+
+	NewCounter("test_evictions_total", "Number of evictions.")
+	g := NewGauge("test_queue", "Queued \"things\".\nSecond line.", "name")
+	g.Set(5, `a"b\c`)
+	NewGaugeFunc("test_size_bytes", "Size.", func() float64 { return 1.5e10 })
+
+	h := NewHistogram("test_duration_seconds", "Duration.", []float64{0.1, 1}, "route")
+	h.Observe(0.05, "/")
+	h.Observe(0.5, "/")
+	h.Observe(2, "/")
+
+	buf := &bytes.Buffer{}
+	n, err := Default.WriteTo(buf)
+	require.NoError(t, err)
+	require.Equal(t, int64(buf.Len()), n)
+	require.Equal(t, `# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="/",le="0.1"} 1
+test_duration_seconds_bucket{route="/",le="1"} 2
+test_duration_seconds_bucket{route="/",le="+Inf"} 3
+test_duration_seconds_sum{route="/"} 2.55
+test_duration_seconds_count{route="/"} 3
+# HELP test_evictions_total Number of evictions.
+# TYPE test_evictions_total counter
+test_evictions_total 0
+# HELP test_queue Queued "things".\nSecond line.
+# TYPE test_queue gauge
+test_queue{name="a\"b\\c"} 5
+# HELP test_requests_total Number of requests.
+# TYPE test_requests_total counter
+test_requests_total{route="/api/search",code="429"} 1
+test_requests_total{route="/d/:id",code="200"} 3
+# HELP test_size_bytes Size.
+# TYPE test_size_bytes gauge
+test_size_bytes 1.5e+10
+`, buf.String())
+
+	require.Panics(t, func() { NewGauge("test_queue", "Again.") })
+	require.Panics(t, func() { c.Inc("/") })
+}
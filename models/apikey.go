@@ -0,0 +1,141 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// These are the scopes which can be given to an APIKey.
+const (
+	// ScopeDownload allows to download ranked, approved, qualified and loved
+	// sets.
+	ScopeDownload = "download"
+	// ScopeDownloadUnranked allows to download any set.
+	ScopeDownloadUnranked = "download-unranked"
+	// ScopeSearch allows to search sets and fetch their metadata.
+	ScopeSearch = "search"
+	// ScopeAdmin allows to manage CheeseGull, and implies all of the other
+	// scopes.
+	ScopeAdmin = "admin"
+)
+
+// Scopes are all the valid scopes.
+var Scopes = []string{ScopeDownload, ScopeDownloadUnranked, ScopeSearch, ScopeAdmin}
+
+// APIKey is a key used by a client of the API to authenticate. Only a hash of
+// the key itself is stored.
+type APIKey struct {
+	ID        int
+	Name      string
+	Scopes    []string
+	CreatedAt time.Time
+}
+
+// HasScope checks whether the key has the given scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func hashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// CreateAPIKey creates a new random API key with the given name and scopes,
+// and returns it. The key can't be retrieved again afterwards.
+func CreateAPIKey(db *sql.DB, name string, scopes []string) (string, error) {
+	for _, s := range scopes {
+		if !ValidScope(s) {
+			return "", fmt.Errorf("cheesegull/models: invalid scope %q", s)
+		}
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(b)
+	_, err := db.Exec(
+		"INSERT INTO api_keys(name, key_hash, scopes, created_at) VALUES (?, ?, ?, ?)",
+		name, hashAPIKey(key), strings.Join(scopes, ","), time.Now(),
+	)
+	return key, err
+}
+
+// ValidScope checks whether scope is one of Scopes.
+func ValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+const apiKeyFields = "id, name, scopes, created_at"
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (APIKey, error) {
+	var (
+		k      APIKey
+		scopes string
+	)
+	err := row.Scan(&k.ID, &k.Name, &scopes, &k.CreatedAt)
+	if scopes != "" {
+		k.Scopes = strings.Split(scopes, ",")
+	}
+	return k, err
+}
+
+// FetchAPIKey retrieves the APIKey with the given key, or nil if there is
+// none.
+func FetchAPIKey(db *sql.DB, key string) (*APIKey, error) {
+	k, err := scanAPIKey(db.QueryRow(
+		"SELECT "+apiKeyFields+" FROM api_keys WHERE key_hash = ? LIMIT 1", hashAPIKey(key),
+	))
+	switch err {
+	case nil:
+		return &k, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// FetchAPIKeys retrieves all the API keys, sorted by ID.
+func FetchAPIKeys(db *sql.DB) ([]APIKey, error) {
+	rows, err := db.Query("SELECT " + apiKeyFields + " FROM api_keys ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey deletes the API key with the given ID, and returns whether it
+// existed.
+func RevokeAPIKey(db *sql.DB, id int) (bool, error) {
+	res, err := db.Exec("DELETE FROM api_keys WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
@@ -52,4 +52,16 @@ var migrations = [...]string{
 	`ALTER TABLE sets CONVERT TO CHARACTER SET utf8;
 ALTER TABLE beatmaps CONVERT TO CHARACTER SET utf8;
 `,
+	`CREATE TABLE api_keys(
+	id INT NOT NULL AUTO_INCREMENT,
+	name VARCHAR(255) NOT NULL,
+	key_hash CHAR(64) NOT NULL,
+	scopes VARCHAR(255) NOT NULL,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY(id),
+	UNIQUE KEY(key_hash)
+);
+`,
+	`ALTER TABLE sets ADD INDEX last_checked (last_checked);`,
+	`ALTER TABLE beatmaps ADD INDEX parent_set_playcount (parent_set_id, playcount);`,
 }
@@ -0,0 +1,9 @@
+CREATE TABLE api_keys(
+	id INT NOT NULL AUTO_INCREMENT,
+	name VARCHAR(255) NOT NULL,
+	key_hash CHAR(64) NOT NULL,
+	scopes VARCHAR(255) NOT NULL,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY(id),
+	UNIQUE KEY(key_hash)
+);
@@ -0,0 +1 @@
+ALTER TABLE sets ADD INDEX last_checked (last_checked);
\ No newline at end of file
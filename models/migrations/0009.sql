@@ -0,0 +1 @@
+ALTER TABLE beatmaps ADD INDEX parent_set_playcount (parent_set_id, playcount);
\ No newline at end of file
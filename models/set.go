@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"time"
 )
@@ -48,10 +49,15 @@ LIMIT ?`,
 		return nil, err
 	}
 
-	sets := make([]Set, 0, limit)
+	return readSetsFromRows(rows, limit)
+}
+
+func readSetsFromRows(rows *sql.Rows, capacity int) ([]Set, error) {
+	defer rows.Close()
+	sets := make([]Set, 0, capacity)
 	for rows.Next() {
 		var s Set
-		err = rows.Scan(
+		err := rows.Scan(
 			&s.ID, &s.RankedStatus, &s.ApprovedDate, &s.LastUpdate, &s.LastChecked,
 			&s.Artist, &s.Title, &s.Creator, &s.Source, &s.Tags, &s.HasVideo, &s.Genre,
 			&s.Language, &s.Favourites,
@@ -65,6 +71,40 @@ LIMIT ?`,
 	return sets, rows.Err()
 }
 
+// FetchRecentlyRankedSets fetches up to limit sets which have become ranked,
+// approved or loved after since, most recent first.
+func FetchRecentlyRankedSets(db *sql.DB, since time.Time, limit int) ([]Set, error) {
+	rows, err := db.Query(`
+SELECT `+setFields+` FROM sets
+WHERE ranked_status IN (1, 2, 4) AND approved_date >= ?
+ORDER BY approved_date DESC
+LIMIT ?`, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	return readSetsFromRows(rows, limit)
+}
+
+// FetchPopularSets fetches up to limit ranked, approved, qualified or loved
+// sets which have at least minFavourites favourites, or whose beatmaps have
+// been played at least minPlaycount times in total. The most favourited sets
+// come first.
+func FetchPopularSets(db *sql.DB, minFavourites, minPlaycount, limit int) ([]Set, error) {
+	rows, err := db.Query(`
+SELECT `+setFields+` FROM sets
+WHERE ranked_status > 0 AND (favourites >= ? OR id IN (
+	SELECT parent_set_id FROM beatmaps
+	GROUP BY parent_set_id
+	HAVING SUM(playcount) >= ?
+))
+ORDER BY favourites DESC
+LIMIT ?`, minFavourites, minPlaycount, limit)
+	if err != nil {
+		return nil, err
+	}
+	return readSetsFromRows(rows, limit)
+}
+
 // FetchSet retrieves a single set to show, alongside its children beatmaps.
 func FetchSet(db *sql.DB, id int, withChildren bool) (*Set, error) {
 	var s Set
@@ -158,3 +198,15 @@ func BiggestSetID(db *sql.DB) (int, error) {
 	}
 	return i, err
 }
+
+// NewestLastChecked returns the most recent LastChecked of the sets, which
+// tells whether the set updater is keeping up. If there are no sets, the zero
+// time is returned.
+func NewestLastChecked(ctx context.Context, db *sql.DB) (time.Time, error) {
+	var t time.Time
+	err := db.QueryRowContext(ctx, "SELECT last_checked FROM sets ORDER BY last_checked DESC LIMIT 1").Scan(&t)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return t, err
+}
@@ -0,0 +1,312 @@
+// Package prefetch downloads into the cache the beatmap sets which are likely
+// to be requested soon, such as the ones which have just been ranked, so that
+// their first requesters don't all have to wait for them to be downloaded.
+package prefetch
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+
+	"github.com/osuripple/cheesegull/downloader"
+	"github.com/osuripple/cheesegull/housekeeper"
+	"github.com/osuripple/cheesegull/models"
+)
+
+// Source finds the sets which should be prefetched, in order of importance.
+type Source interface {
+	Sets() ([]models.Set, error)
+}
+
+// DBSource finds the sets to prefetch in the sets mirrored by dbmirror: first
+// the ones which have recently become ranked, approved or loved, and then the
+// most popular ones.
+type DBSource struct {
+	DB *sql.DB
+	// RankedWithin is how long ago a set may have been ranked or loved to be
+	// prefetched.
+	RankedWithin time.Duration
+	// MinFavourites and MinPlaycount are the minimum number of favourites and
+	// total plays that make a set popular.
+	MinFavourites int
+	MinPlaycount  int
+	// Limit is the maximum number of sets of each kind to return.
+	Limit int
+
+	// popular are the popular sets, fetched at popularFetched. Finding them
+	// adds up the playcounts of all the beatmaps, so they are cached for
+	// popularSetsTTL.
+	popular        []models.Set
+	popularFetched time.Time
+}
+
+// popularSetsTTL is how long DBSource caches the popular sets. Sets take much
+// longer than this to become popular.
+const popularSetsTTL = time.Hour * 6
+
+// Sets returns the recently ranked sets, followed by the popular ones.
+func (s *DBSource) Sets() ([]models.Set, error) {
+	ranked, err := models.FetchRecentlyRankedSets(s.DB, time.Now().Add(-s.RankedWithin), s.Limit)
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(s.popularFetched) > popularSetsTTL {
+		popular, err := models.FetchPopularSets(s.DB, s.MinFavourites, s.MinPlaycount, s.Limit)
+		if err != nil {
+			return nil, err
+		}
+		s.popular, s.popularFetched = popular, time.Now()
+	}
+	return append(ranked, s.popular...), nil
+}
+
+// defaultSetSize is the size assumed for a set before any has been
+// prefetched, to tell whether there is room for it in the cache.
+const defaultSetSize = 20 * 1024 * 1024
+
+// Prefetcher downloads the sets found by a Source into the House. Sets are
+// downloaded one at a time, and only while the cache has room for them:
+// prefetching never causes beatmaps to be evicted.
+type Prefetcher struct {
+	Source Source
+	House  *housekeeper.House
+	Client downloader.Client
+	// Queue, if not nil, is the queue the downloads of the prefetcher wait in,
+	// alongside the ones requested by the users.
+	Queue *downloader.Queue
+	// Rate, if not nil, limits the download speed of the prefetcher.
+	Rate *downloader.RateLimiter
+	// DiskBudget is the maximum number of bytes which may be used by
+	// prefetched sets that have not been requested yet. 0 means unlimited.
+	DiskBudget uint64
+	// Verify, if not nil, is called on every set once it is downloaded. If
+	// it returns an error, the set is discarded like a failed download.
+	Verify func(ctx context.Context, b *housekeeper.CachedBeatmap) error
+	// Logger is used to log what the prefetcher does. If nil, slog.Default()
+	// is used.
+	Logger *slog.Logger
+
+	mtx sync.Mutex
+	// fetched are the sets downloaded by the prefetcher.
+	fetched map[int]bool
+	// fetchedBytes and fetchedCount are used to estimate the size of the
+	// next set.
+	fetchedBytes uint64
+	fetchedCount uint64
+}
+
+// Run prefetches the sets every interval, until ctx is done.
+func (p *Prefetcher) Run(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		n, err := p.Prefetch(ctx)
+		if err != nil && ctx.Err() == nil {
+			p.logError("prefetching failed", err)
+		}
+		if n > 0 {
+			p.logger().Info("prefetched sets", "count", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Prefetch downloads the sets returned by the Source which are not in the
+// cache yet, and returns how many it downloaded. It stops as soon as the disk
+// budget or the cache are full.
+func (p *Prefetcher) Prefetch(ctx context.Context) (int, error) {
+	sets, err := p.Source.Sets()
+	if err != nil {
+		return 0, err
+	}
+
+	used := p.House.Size()
+	budgetUsed := p.budgetUsed()
+	seen := make(map[int]bool, len(sets))
+	n := 0
+	for _, set := range sets {
+		if ctx.Err() != nil {
+			return n, ctx.Err()
+		}
+		if seen[set.ID] || p.cached(set) {
+			continue
+		}
+		seen[set.ID] = true
+
+		expected := p.expectedSize()
+		if used+expected > p.House.MaxSize {
+			p.logger().Info("the cache is full, not prefetching any more sets")
+			break
+		}
+		if p.DiskBudget != 0 && budgetUsed+expected > p.DiskBudget {
+			p.logger().Info("disk budget exhausted, not prefetching any more sets")
+			break
+		}
+
+		size, err := p.fetch(ctx, set)
+		if err != nil {
+			if ctx.Err() != nil {
+				return n, ctx.Err()
+			}
+			p.logError("can't prefetch set", err, "set_id", set.ID)
+			continue
+		}
+		if size > 0 {
+			used += size
+			budgetUsed += size
+			n++
+		}
+	}
+	return n, nil
+}
+
+// cached checks whether an up to date version of the set is already in the
+// cache, or has at least been attempted.
+func (p *Prefetcher) cached(set models.Set) bool {
+	b := p.House.Lookup(set.ID, false)
+	return b != nil && !b.Usage().LastUpdate.Before(set.LastUpdate)
+}
+
+func (p *Prefetcher) expectedSize() uint64 {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.fetchedCount == 0 {
+		return defaultSetSize
+	}
+	return p.fetchedBytes / p.fetchedCount
+}
+
+// budgetUsed returns the number of bytes used by the prefetched sets which are
+// still in the cache and have not been requested yet. Sets which have been
+// requested are no longer accounted to the prefetcher.
+func (p *Prefetcher) budgetUsed() (used uint64) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for id := range p.fetched {
+		b := p.House.Lookup(id, false)
+		if b == nil || b.Requests() > 0 {
+			delete(p.fetched, id)
+			continue
+		}
+		used += b.FileSize()
+	}
+	return
+}
+
+// fetch downloads a set into the cache, and returns its size.
+func (p *Prefetcher) fetch(ctx context.Context, set models.Set) (uint64, error) {
+	b, shouldDownload := p.House.AcquireBeatmap(&housekeeper.CachedBeatmap{
+		ID:         set.ID,
+		LastUpdate: set.LastUpdate,
+	})
+	b.SetRankedStatus(set.RankedStatus)
+	if !shouldDownload {
+		// somebody requested it in the meantime.
+		return 0, nil
+	}
+	p.logger().Info("prefetching set", "set_id", b.ID)
+	// the set was never requested, but it must not be the first to be
+	// evicted either.
+	b.SetLastRequested(time.Now())
+
+	t, err := p.Queue.Acquire(ctx, set.ID)
+	if err != nil {
+		b.DownloadFailed(err, p.House)
+		return 0, err
+	}
+	size, err := p.download(ctx, b)
+	t.Release()
+	if err == nil && size > 0 && p.Verify != nil {
+		err = p.Verify(ctx, b)
+	}
+	if err != nil {
+		b.DownloadFailed(err, p.House)
+		return 0, err
+	}
+	b.DownloadCompleted(size, p.House)
+	if size == 0 {
+		return 0, nil
+	}
+
+	p.mtx.Lock()
+	if p.fetched == nil {
+		p.fetched = make(map[int]bool)
+	}
+	p.fetched[set.ID] = true
+	p.fetchedBytes += size
+	p.fetchedCount++
+	p.mtx.Unlock()
+	return size, nil
+}
+
+func (p *Prefetcher) download(ctx context.Context, b *housekeeper.CachedBeatmap) (uint64, error) {
+	r, err := p.Client.Download(ctx, b.ID, false)
+	if errors.Is(err, downloader.ErrNoRedirect) {
+		// the set can't be downloaded: like for the sets requested by the
+		// users, this is recorded with a size of 0.
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	f, err := b.CreateFile(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, &unlessRequested{b: b, r: r, limited: p.Rate.Reader(ctx, r)})
+	if err != nil {
+		return 0, err
+	}
+	return uint64(n), f.Close()
+}
+
+// unlessRequested reads from limited until the beatmap is requested, and then
+// straight from r: the prefetch rate limit must not slow down the requesters
+// following the download.
+type unlessRequested struct {
+	b       *housekeeper.CachedBeatmap
+	r       io.Reader
+	limited io.Reader
+}
+
+func (u *unlessRequested) Read(p []byte) (int, error) {
+	if u.b.Requests() > 0 {
+		return u.r.Read(p)
+	}
+	return u.limited.Read(p)
+}
+
+var envSentryDSN = os.Getenv("SENTRY_DSN")
+
+func (p *Prefetcher) logger() *slog.Logger {
+	if p.Logger != nil {
+		return p.Logger
+	}
+	return slog.Default()
+}
+
+// logError attempts to log an error to Sentry, as well as to the logger.
+func (p *Prefetcher) logError(msg string, err error, args ...any) {
+	if err == nil {
+		return
+	}
+	if envSentryDSN != "" {
+		raven.CaptureError(err, nil)
+	}
+	p.logger().Error(msg, append(args, "err", err)...)
+}
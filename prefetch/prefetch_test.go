@@ -0,0 +1,189 @@
+package prefetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/osuripple/cheesegull/downloader"
+	"github.com/osuripple/cheesegull/housekeeper"
+	"github.com/osuripple/cheesegull/models"
+)
+
+type fakeSource []models.Set
+
+func (s fakeSource) Sets() ([]models.Set, error) { return s, nil }
+
+// fakeClient serves sets of the given sizes, and fails to download the
+// others with ErrNoRedirect.
+type fakeClient struct {
+	mtx        sync.Mutex
+	sizes      map[int]int
+	downloaded []int
+}
+
+func (c *fakeClient) Download(ctx context.Context, setID int, noVideo bool) (io.ReadCloser, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.downloaded = append(c.downloaded, setID)
+	size, ok := c.sizes[setID]
+	if !ok {
+		return nil, downloader.ErrNoRedirect
+	}
+	return io.NopCloser(bytes.NewReader(make([]byte, size))), nil
+}
+
+func newTestHouse(t *testing.T) *housekeeper.House {
+	dir := t.TempDir()
+	h := housekeeper.New(filepath.Join(dir, "cgbin.db"))
+	h.Storage = housekeeper.LocalStorage(filepath.Join(dir, "data"))
+	return h
+}
+
+func testSets(ids ...int) fakeSource {
+	lastUpdate := time.Date(2020, 4, 5, 15, 5, 3, 0, time.UTC)
+	s := make(fakeSource, len(ids))
+	for i, id := range ids {
+		s[i] = models.Set{ID: id, RankedStatus: 1, LastUpdate: lastUpdate}
+	}
+	return s
+}
+
+func TestPrefetch(t *testing.T) {
+	h := newTestHouse(t)
+	cl := &fakeClient{sizes: map[int]int{1: 10000, 2: 20000, 4: 30000}}
+	p := &Prefetcher{
+		// 1 is both recently ranked and popular.
+		Source: testSets(1, 2, 3, 1, 4),
+		House:  h,
+		Client: cl,
+	}
+
+	n, err := p.Prefetch(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.Equal(t, []int{1, 2, 3, 4}, cl.downloaded)
+	require.Equal(t, uint64(60000), h.Size())
+
+	b := h.Lookup(2, false)
+	require.NotNil(t, b)
+	require.True(t, b.IsDownloaded())
+	require.Equal(t, 1, b.RankedStatus)
+	// sets which could not be downloaded are recorded like the requested ones.
+	require.Equal(t, uint64(0), h.Lookup(3, false).FileSize())
+
+	// sets which are already cached, or could not be downloaded, are not
+	// downloaded again.
+	n, err = p.Prefetch(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	require.Len(t, cl.downloaded, 4)
+}
+
+func TestPrefetchBudget(t *testing.T) {
+	h := newTestHouse(t)
+	cl := &fakeClient{sizes: map[int]int{1: 10000, 2: 10000, 3: 10000, 4: 10000}}
+	p := &Prefetcher{
+		Source:     testSets(1, 2, 3, 4),
+		House:      h,
+		Client:     cl,
+		DiskBudget: 25000,
+	}
+	// the size of the first set is unknown: make sure it fits.
+	p.fetchedBytes, p.fetchedCount = 10000, 1
+
+	n, err := p.Prefetch(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	// once a prefetched set is requested, it no longer uses the budget.
+	h.Requested(h.Lookup(1, false))
+	n, err = p.Prefetch(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, []int{1, 2, 3}, cl.downloaded)
+
+	// prefetching must never fill the cache over MaxSize.
+	p.DiskBudget = 0
+	h.MaxSize = 35000
+	n, err = p.Prefetch(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestPrefetchCancel(t *testing.T) {
+	h := newTestHouse(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := &Prefetcher{
+		Source: testSets(1),
+		House:  h,
+		Client: &fakeClient{},
+	}
+	_, err := p.Prefetch(ctx)
+	require.True(t, errors.Is(err, context.Canceled))
+	require.Nil(t, h.Lookup(1, false))
+}
+
+func TestPrefetchVerify(t *testing.T) {
+	h := newTestHouse(t)
+	cl := &fakeClient{sizes: map[int]int{1: 10000, 2: 20000}}
+	var verified []int
+	p := &Prefetcher{
+		Source: testSets(1, 2, 3),
+		House:  h,
+		Client: cl,
+		Verify: func(ctx context.Context, b *housekeeper.CachedBeatmap) error {
+			verified = append(verified, b.ID)
+			if b.ID == 2 {
+				return errors.New("archive does not match")
+			}
+			return nil
+		},
+	}
+
+	n, err := p.Prefetch(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	// sets which could not be downloaded are not verified.
+	require.Equal(t, []int{1, 2}, verified)
+	// rejected sets are discarded like failed downloads.
+	require.Equal(t, uint64(10000), h.Size())
+	require.Equal(t, uint64(0), h.Lookup(2, false).FileSize())
+}
+
+// requestingClient serves sets as if a user requested them right as their
+// download starts.
+type requestingClient struct {
+	fakeClient
+	h *housekeeper.House
+}
+
+func (c *requestingClient) Download(ctx context.Context, setID int, noVideo bool) (io.ReadCloser, error) {
+	c.h.Requested(c.h.Lookup(setID, noVideo))
+	return c.fakeClient.Download(ctx, setID, noVideo)
+}
+
+func TestPrefetchRequestedIsNotThrottled(t *testing.T) {
+	h := newTestHouse(t)
+	p := &Prefetcher{
+		Source: testSets(1),
+		House:  h,
+		Client: &requestingClient{fakeClient{sizes: map[int]int{1: 1000000}}, h},
+		// prefetching the set would take 100 seconds.
+		Rate: downloader.NewRateLimiter(10000),
+	}
+
+	start := time.Now()
+	n, err := p.Prefetch(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Less(t, time.Since(start), time.Second*5)
+}